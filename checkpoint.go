@@ -0,0 +1,145 @@
+package blackbox
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const CHECKPOINT_INTERVAL = 1 * time.Second
+
+// Checkpoint records how far into a file its lines have been accepted by
+// the drainer. The device and inode identify the file so that a rotated or
+// recreated file at the same path is not resumed at a stale offset.
+type Checkpoint struct {
+	Device uint64 `json:"device"`
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+func CheckpointFor(info os.FileInfo, offset int64) Checkpoint {
+	device, inode := fileIdentity(info)
+
+	return Checkpoint{
+		Device: device,
+		Inode:  inode,
+		Offset: offset,
+	}
+}
+
+// Matches reports whether the checkpoint was taken against the file
+// described by info.
+func (c Checkpoint) Matches(info os.FileInfo) bool {
+	device, inode := fileIdentity(info)
+	return c.Device == device && c.Inode == inode
+}
+
+type Checkpoints struct {
+	logger *log.Logger
+	path   string
+
+	lock        sync.Mutex
+	checkpoints map[string]Checkpoint
+	dirty       bool
+}
+
+func LoadCheckpoints(logger *log.Logger, path string) (*Checkpoints, error) {
+	checkpoints := &Checkpoints{
+		logger:      logger,
+		path:        path,
+		checkpoints: map[string]Checkpoint{},
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return checkpoints, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(contents, &checkpoints.checkpoints); err != nil {
+		return nil, err
+	}
+
+	return checkpoints, nil
+}
+
+func (c *Checkpoints) Get(path string) (Checkpoint, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	checkpoint, found := c.checkpoints[path]
+	return checkpoint, found
+}
+
+func (c *Checkpoints) Set(path string, checkpoint Checkpoint) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.checkpoints[path] = checkpoint
+	c.dirty = true
+}
+
+// Save writes the checkpoints to the state file if they have changed since
+// the last save. The file is replaced atomically so that a crash mid-write
+// never leaves a truncated state file behind.
+func (c *Checkpoints) Save() error {
+	c.lock.Lock()
+	if !c.dirty {
+		c.lock.Unlock()
+		return nil
+	}
+
+	contents, err := json.Marshal(c.checkpoints)
+	c.dirty = false
+	c.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path))
+	if err != nil {
+		return err
+	}
+
+	_, err = tmpFile.Write(contents)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), c.path)
+}
+
+func (c *Checkpoints) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	ticker := time.NewTicker(CHECKPOINT_INTERVAL)
+	defer ticker.Stop()
+
+	close(ready)
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.Save(); err != nil {
+				c.logger.Printf("could not save checkpoints to %s: %s\n", c.path, err)
+			}
+		case <-signals:
+			return c.Save()
+		}
+	}
+}
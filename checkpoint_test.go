@@ -0,0 +1,89 @@
+package blackbox_test
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	. "github.com/concourse/blackbox"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Checkpoints", func() {
+	var (
+		stateDir  string
+		statePath string
+		logger    *log.Logger
+	)
+
+	BeforeEach(func() {
+		var err error
+		stateDir, err = ioutil.TempDir("", "blackbox-state")
+		Expect(err).NotTo(HaveOccurred())
+
+		statePath = filepath.Join(stateDir, "state.json")
+		logger = log.New(GinkgoWriter, "", 0)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(stateDir)
+	})
+
+	It("starts empty when the state file does not exist", func() {
+		checkpoints, err := LoadCheckpoints(logger, statePath)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, found := checkpoints.Get("/some/file.log")
+		Expect(found).To(BeFalse())
+	})
+
+	It("persists checkpoints across loads", func() {
+		checkpoints, err := LoadCheckpoints(logger, statePath)
+		Expect(err).NotTo(HaveOccurred())
+
+		checkpoints.Set("/some/file.log", Checkpoint{Device: 1, Inode: 2, Offset: 42})
+		Expect(checkpoints.Save()).To(Succeed())
+
+		reloaded, err := LoadCheckpoints(logger, statePath)
+		Expect(err).NotTo(HaveOccurred())
+
+		checkpoint, found := reloaded.Get("/some/file.log")
+		Expect(found).To(BeTrue())
+		Expect(checkpoint).To(Equal(Checkpoint{Device: 1, Inode: 2, Offset: 42}))
+	})
+
+	It("fails to load a corrupt state file", func() {
+		err := ioutil.WriteFile(statePath, []byte("{not json"), 0644)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = LoadCheckpoints(logger, statePath)
+		Expect(err).To(HaveOccurred())
+	})
+
+	Describe("Matches", func() {
+		It("only matches the file the checkpoint was taken against", func() {
+			first := filepath.Join(stateDir, "first.log")
+			second := filepath.Join(stateDir, "second.log")
+			Expect(ioutil.WriteFile(first, []byte("a\n"), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(second, []byte("b\n"), 0644)).To(Succeed())
+
+			firstInfo, err := os.Stat(first)
+			Expect(err).NotTo(HaveOccurred())
+
+			secondInfo, err := os.Stat(second)
+			Expect(err).NotTo(HaveOccurred())
+
+			checkpoints, err := LoadCheckpoints(logger, statePath)
+			Expect(err).NotTo(HaveOccurred())
+
+			checkpoints.Set(first, CheckpointFor(firstInfo, 2))
+			checkpoint, _ := checkpoints.Get(first)
+
+			Expect(checkpoint.Matches(firstInfo)).To(BeTrue())
+			Expect(checkpoint.Matches(secondInfo)).To(BeFalse())
+		})
+	})
+})
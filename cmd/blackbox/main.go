@@ -3,13 +3,17 @@ package main
 import (
 	"flag"
 	"log"
+	"net/http"
 	"os"
+	"time"
 
 	"github.com/tedsuo/ifrit"
 	"github.com/tedsuo/ifrit/grouper"
+	"github.com/tedsuo/ifrit/http_server"
 	"github.com/tedsuo/ifrit/sigmon"
 
 	"github.com/concourse/blackbox"
+	"github.com/concourse/blackbox/metrics"
 	"github.com/concourse/blackbox/syslog"
 )
 
@@ -33,12 +37,48 @@ func main() {
 		logger.Fatalf("could not load config file: %s\n", err)
 	}
 
+	var checkpoints *blackbox.Checkpoints
+	if config.Syslog.StateFile != "" {
+		checkpoints, err = blackbox.LoadCheckpoints(logger, config.Syslog.StateFile)
+		if err != nil {
+			logger.Fatalf("could not load state file: %s\n", err)
+		}
+	}
+
 	group := grouper.NewDynamic(nil, 0, 0)
-	running := ifrit.Invoke(sigmon.New(group))
+	health := blackbox.NewHealth(time.Duration(config.HTTP.UnhealthyAfter))
+	drainerFactory := syslog.NewDrainerFactory(config.Syslog.Drains(), config.Hostname)
+
+	// members are stopped in reverse order, so tailers are stopped before
+	// queued lines are flushed and the final checkpoint is written, and
+	// metrics are served until then
+	var members grouper.Members
+
+	if checkpoints != nil {
+		members = append(members, grouper.Member{Name: "checkpoints", Runner: checkpoints})
+	}
+
+	if config.HTTP.Address != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		mux.HandleFunc("/healthz", health.ServeHealthz)
+		mux.HandleFunc("/readyz", health.ServeReadyz)
+
+		members = append(members, grouper.Member{Name: "http", Runner: http_server.New(config.HTTP.Address, mux)})
+	}
+
+	members = append(members,
+		grouper.Member{Name: "connections", Runner: &blackbox.Connections{
+			DrainerFactory:      drainerFactory,
+			ShutdownGracePeriod: time.Duration(config.Syslog.ShutdownGracePeriod),
+		}},
+		grouper.Member{Name: "tailers", Runner: group},
+	)
+
+	running := ifrit.Invoke(sigmon.New(grouper.NewOrdered(os.Interrupt, members)))
 
 	go func() {
-		drainerFactory := syslog.NewDrainerFactory(config.Syslog.Destination, config.Hostname)
-		fileWatcher := blackbox.NewFileWatcher(logger, config.Syslog.SourceDir, group.Client(), drainerFactory)
+		fileWatcher := blackbox.NewFileWatcher(logger, config.Syslog, group.Client(), drainerFactory, checkpoints, health)
 		fileWatcher.Watch()
 	}()
 
@@ -2,10 +2,16 @@ package blackbox
 
 import (
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"time"
 
+	"github.com/bmatcuk/doublestar"
 	"github.com/concourse/blackbox/syslog"
 	"gopkg.in/yaml.v2"
 )
@@ -34,15 +40,367 @@ func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
+type Regexp struct {
+	*regexp.Regexp
+}
+
+func (r *Regexp) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var str string
+	if err := unmarshal(&str); err != nil {
+		return err
+	}
+
+	if str == "" {
+		r.Regexp = nil
+		return nil
+	}
+
+	compiled, err := regexp.Compile(str)
+	if err != nil {
+		return err
+	}
+
+	r.Regexp = compiled
+
+	return nil
+}
+
+func (r Regexp) MarshalYAML() (interface{}, error) {
+	if r.Regexp == nil {
+		return "", nil
+	}
+
+	return r.String(), nil
+}
+
+// PriorityRule sets the facility and/or severity of lines from files whose
+// tag or path match. Tag and File are glob patterns; File is matched against
+// the path of the file relative to the source directory, e.g. "*/stderr.log".
+// A rule with both patterns only applies when both of them match.
+type PriorityRule struct {
+	Tag  string `yaml:"tag,omitempty"`
+	File string `yaml:"file,omitempty"`
+
+	Facility *syslog.Facility `yaml:"facility,omitempty"`
+	Severity *syslog.Severity `yaml:"severity,omitempty"`
+}
+
+func (r PriorityRule) matches(tag string, relPath string) bool {
+	if r.Tag != "" {
+		if matched, _ := path.Match(r.Tag, tag); !matched {
+			return false
+		}
+	}
+
+	if r.File != "" {
+		if matched, _ := filepath.Match(r.File, relPath); !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// SeverityPattern assigns a severity to any line matching its pattern,
+// overriding the severity determined by the priority rules.
+type SeverityPattern struct {
+	Pattern  Regexp          `yaml:"pattern"`
+	Severity syslog.Severity `yaml:"severity"`
+}
+
+// MultilineRule joins consecutive lines from files with a matching tag into
+// a single message. A line matching Start always begins a new message.
+// Otherwise it continues the current message if it matches Continuation or,
+// when only Start is configured, if it does not match Start.
+type MultilineRule struct {
+	Tag          string   `yaml:"tag"`
+	Start        Regexp   `yaml:"start,omitempty"`
+	Continuation Regexp   `yaml:"continuation,omitempty"`
+	MaxLines     int      `yaml:"max_lines,omitempty"`
+	FlushTimeout Duration `yaml:"flush_timeout,omitempty"`
+}
+
+// JSONRule parses lines from files with a matching tag as JSON objects, such
+// as lager's output. The message, severity and timestamp are taken from the
+// named fields, and every other field is sent along with the message. Lines
+// that are not JSON objects are sent unchanged.
+type JSONRule struct {
+	Tag string `yaml:"tag"`
+
+	MessageField   string `yaml:"message_field,omitempty"`
+	SeverityField  string `yaml:"severity_field,omitempty"`
+	TimestampField string `yaml:"timestamp_field,omitempty"`
+}
+
+// RateLimit caps how fast lines from files with a matching tag are sent, so
+// that one app logging in a hot loop cannot flood the destinations. Every tag
+// it matches is limited separately. Lines over the limit are dropped, and a
+// summary of how many were dropped is sent every SummaryInterval instead.
+type RateLimit struct {
+	Tag string `yaml:"tag"`
+
+	// LinesPerSecond and BytesPerSecond are the sustained rates lines are let
+	// through at; either may be 0 to leave it unlimited.
+	LinesPerSecond float64 `yaml:"lines_per_second,omitempty"`
+	BytesPerSecond float64 `yaml:"bytes_per_second,omitempty"`
+
+	// BurstLines and BurstBytes are how much may be sent at once after a
+	// quiet spell. They default to a second's worth.
+	BurstLines int `yaml:"burst_lines,omitempty"`
+	BurstBytes int `yaml:"burst_bytes,omitempty"`
+
+	SummaryInterval Duration `yaml:"summary_interval,omitempty"`
+}
+
 type SyslogConfig struct {
-	Destination syslog.Drain `yaml:"destination"`
-	SourceDir   string       `yaml:"source_dir"`
+	// Destination is a single destination, kept for compatibility with
+	// configs that predate Destinations.
+	Destination  syslog.Drain   `yaml:"destination,omitempty"`
+	Destinations []syslog.Drain `yaml:"destinations,omitempty"`
+
+	SourceDir string `yaml:"source_dir"`
+
+	// Include and Exclude are doublestar globs matched against paths relative
+	// to SourceDir. A file is tailed if it matches an Include pattern and no
+	// Exclude pattern; an excluded directory is not descended into at all.
+	Include []string `yaml:"include,omitempty"`
+	Exclude []string `yaml:"exclude,omitempty"`
+
+	Tag TagConfig `yaml:"tag,omitempty"`
+
+	// RemovalGracePeriod is how long a file must have been deleted for before
+	// its tailer is stopped.
+	RemovalGracePeriod Duration `yaml:"removal_grace_period,omitempty"`
+
+	// ShutdownGracePeriod is how long tailers are given on shutdown to read
+	// the rest of their files and deliver what they read.
+	ShutdownGracePeriod Duration `yaml:"shutdown_grace_period,omitempty"`
+
+	// Watch is how new files and changes to files are noticed: "inotify",
+	// "poll", or "auto" (the default) to use inotify unless the source dir is
+	// on a filesystem that does not support it.
+	Watch string `yaml:"watch,omitempty"`
+
+	// StateFile is where read positions are checkpointed so that tailing
+	// resumes where it left off across restarts. Checkpointing is disabled
+	// when it is empty.
+	StateFile string `yaml:"state_file,omitempty"`
+
+	Priorities       []PriorityRule    `yaml:"priorities,omitempty"`
+	SeverityPatterns []SeverityPattern `yaml:"severity_patterns,omitempty"`
+	Multiline        []MultilineRule   `yaml:"multiline,omitempty"`
+	RateLimits       []RateLimit       `yaml:"rate_limits,omitempty"`
+	JSON             []JSONRule        `yaml:"json,omitempty"`
+}
+
+// DefaultInclude matches every .log file in any directory below the source
+// dir.
+var DefaultInclude = []string{"*/**/*.log"}
+
+func (c SyslogConfig) Included(relPath string) bool {
+	include := c.Include
+	if len(include) == 0 {
+		include = DefaultInclude
+	}
+
+	return matchesAny(include, relPath)
+}
+
+// Excluded reports whether relPath matches an Exclude pattern. Directories
+// are also excluded by patterns matching everything beneath them, such as
+// "app1/tmp/**".
+func (c SyslogConfig) Excluded(relPath string, isDir bool) bool {
+	for _, pattern := range c.Exclude {
+		if globMatch(pattern, relPath) {
+			return true
+		}
+
+		if isDir && strings.HasSuffix(pattern, "/**") && globMatch(strings.TrimSuffix(pattern, "/**"), relPath) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchesAny(patterns []string, relPath string) bool {
+	for _, pattern := range patterns {
+		if globMatch(pattern, relPath) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func globMatch(pattern string, relPath string) bool {
+	matched, _ := doublestar.Match(pattern, filepath.ToSlash(relPath))
+	return matched
+}
+
+func (c SyslogConfig) WatchMode() string {
+	if c.Watch == "" {
+		return WatchModeAuto
+	}
+
+	return c.Watch
+}
+
+// Drains returns every destination that lines are delivered to.
+func (c SyslogConfig) Drains() []syslog.Drain {
+	drains := c.Destinations
+	if c.Destination.Address != "" {
+		drains = append([]syslog.Drain{c.Destination}, drains...)
+	}
+
+	return drains
+}
+
+// Priority returns the facility and severity for lines from the file at
+// relPath. The first matching rule that sets each of them wins; lines default
+// to the user facility at info severity.
+func (c SyslogConfig) Priority(tag string, relPath string) (syslog.Facility, syslog.Severity) {
+	facility, severity := syslog.DefaultFacility, syslog.DefaultSeverity
+	facilitySet, severitySet := false, false
+
+	for _, rule := range c.Priorities {
+		if !rule.matches(tag, relPath) {
+			continue
+		}
+
+		if rule.Facility != nil && !facilitySet {
+			facility, facilitySet = *rule.Facility, true
+		}
+
+		if rule.Severity != nil && !severitySet {
+			severity, severitySet = *rule.Severity, true
+		}
+	}
+
+	return facility, severity
+}
+
+// MultilineRule returns the first multiline rule matching tag, or nil if
+// lines with that tag are sent individually.
+func (c SyslogConfig) MultilineRule(tag string) *MultilineRule {
+	for i, rule := range c.Multiline {
+		if matched, _ := path.Match(rule.Tag, tag); matched {
+			return &c.Multiline[i]
+		}
+	}
+
+	return nil
+}
+
+// JSONRule returns the first JSON rule matching tag, or nil if lines with
+// that tag are sent as they are.
+func (c SyslogConfig) JSONRule(tag string) *JSONRule {
+	for i, rule := range c.JSON {
+		if matched, _ := path.Match(rule.Tag, tag); matched {
+			return &c.JSON[i]
+		}
+	}
+
+	return nil
+}
+
+// RateLimit returns the first rate limit matching tag, or nil if lines with
+// that tag are not limited.
+func (c SyslogConfig) RateLimit(tag string) *RateLimit {
+	for i, limit := range c.RateLimits {
+		if matched, _ := path.Match(limit.Tag, tag); matched {
+			return &c.RateLimits[i]
+		}
+	}
+
+	return nil
+}
+
+func (c SyslogConfig) validate() error {
+	if len(c.Drains()) == 0 {
+		return errors.New("no syslog destinations configured")
+	}
+
+	for _, pattern := range append(c.Include, c.Exclude...) {
+		if _, err := doublestar.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid glob '%s': %s", pattern, err)
+		}
+	}
+
+	switch c.WatchMode() {
+	case WatchModeAuto, WatchModeInotify, WatchModePoll:
+	default:
+		return fmt.Errorf("unknown watch mode: %s", c.Watch)
+	}
+
+	for _, rule := range c.Multiline {
+		if _, err := path.Match(rule.Tag, ""); err != nil {
+			return fmt.Errorf("invalid multiline tag pattern '%s': %s", rule.Tag, err)
+		}
+
+		if rule.Start.Regexp == nil && rule.Continuation.Regexp == nil {
+			return fmt.Errorf("multiline rule for '%s' needs a start or continuation pattern", rule.Tag)
+		}
+	}
+
+	for _, rule := range c.JSON {
+		if _, err := path.Match(rule.Tag, ""); err != nil {
+			return fmt.Errorf("invalid json tag pattern '%s': %s", rule.Tag, err)
+		}
+	}
+
+	for _, limit := range c.RateLimits {
+		if _, err := path.Match(limit.Tag, ""); err != nil {
+			return fmt.Errorf("invalid rate limit tag pattern '%s': %s", limit.Tag, err)
+		}
+
+		if limit.LinesPerSecond < 0 || limit.BytesPerSecond < 0 || limit.BurstLines < 0 || limit.BurstBytes < 0 {
+			return fmt.Errorf("rate limit for '%s' must not be negative", limit.Tag)
+		}
+
+		if limit.LinesPerSecond == 0 && limit.BytesPerSecond == 0 {
+			return fmt.Errorf("rate limit for '%s' needs lines_per_second or bytes_per_second", limit.Tag)
+		}
+	}
+
+	for _, pattern := range c.SeverityPatterns {
+		if pattern.Pattern.Regexp == nil {
+			return errors.New("severity pattern must not be empty")
+		}
+	}
+
+	for _, rule := range c.Priorities {
+		if _, err := path.Match(rule.Tag, ""); err != nil {
+			return fmt.Errorf("invalid priority tag pattern '%s': %s", rule.Tag, err)
+		}
+
+		if _, err := filepath.Match(rule.File, ""); err != nil {
+			return fmt.Errorf("invalid priority file pattern '%s': %s", rule.File, err)
+		}
+	}
+
+	return nil
 }
 
 type Config struct {
 	Hostname string `yaml:"hostname"`
 
 	Syslog SyslogConfig `yaml:"syslog"`
+
+	HTTP HTTPConfig `yaml:"http,omitempty"`
+}
+
+// HTTPConfig configures the optional HTTP server, which serves Prometheus
+// metrics at /metrics, and liveness and readiness at /healthz and /readyz.
+type HTTPConfig struct {
+	// Address is where the server listens, such as "127.0.0.1:9391". There is
+	// no server when it is empty.
+	Address string `yaml:"address,omitempty"`
+
+	// UnhealthyAfter is how long the watch loop may stall, or every
+	// destination be down, before /healthz fails. Defaults to
+	// DEFAULT_UNHEALTHY_AFTER.
+	UnhealthyAfter Duration `yaml:"unhealthy_after,omitempty"`
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -57,6 +415,10 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, err
 	}
 
+	if err := config.Syslog.validate(); err != nil {
+		return nil, err
+	}
+
 	if config.Hostname == "" {
 		hostname, err := os.Hostname()
 		if err != nil {
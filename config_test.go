@@ -1,9 +1,12 @@
 package blackbox_test
 
 import (
+	"io/ioutil"
+	"os"
 	"time"
 
 	. "github.com/concourse/blackbox"
+	"github.com/concourse/blackbox/syslog"
 	"gopkg.in/yaml.v2"
 
 	. "github.com/onsi/ginkgo"
@@ -28,4 +31,172 @@ var _ = Describe("Config", func() {
 			Expect(time.Duration(duration)).To(Equal(10 * time.Nanosecond))
 		})
 	})
+
+	Describe("SyslogConfig", func() {
+		Describe("Priority", func() {
+			var config SyslogConfig
+
+			BeforeEach(func() {
+				err := yaml.Unmarshal([]byte(`
+priorities:
+- file: "*/stderr.log"
+  severity: err
+- tag: audit
+  facility: auth
+  severity: notice
+`), &config)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("defaults to the user facility at info severity", func() {
+				facility, severity := config.Priority("app1", "app1/stdout.log")
+				Expect(facility).To(Equal(syslog.DefaultFacility))
+				Expect(severity).To(Equal(syslog.DefaultSeverity))
+			})
+
+			It("matches files by their path relative to the source directory", func() {
+				_, severity := config.Priority("app1", "app1/stderr.log")
+				Expect(severity.String()).To(Equal("err"))
+			})
+
+			It("matches tags", func() {
+				facility, severity := config.Priority("audit", "audit/stdout.log")
+				Expect(facility.String()).To(Equal("auth"))
+				Expect(severity.String()).To(Equal("notice"))
+			})
+
+			It("takes each of facility and severity from the first rule that sets it", func() {
+				facility, severity := config.Priority("audit", "audit/stderr.log")
+				Expect(facility.String()).To(Equal("auth"))
+				Expect(severity.String()).To(Equal("err"))
+			})
+		})
+
+		Describe("RateLimit", func() {
+			var config SyslogConfig
+
+			BeforeEach(func() {
+				err := yaml.Unmarshal([]byte(`
+rate_limits:
+- tag: noisy-*
+  lines_per_second: 100
+  burst_lines: 500
+  summary_interval: 30s
+`), &config)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("returns the first limit matching the tag", func() {
+				limit := config.RateLimit("noisy-app")
+				Expect(limit).NotTo(BeNil())
+				Expect(limit.LinesPerSecond).To(Equal(100.0))
+				Expect(limit.BurstLines).To(Equal(500))
+				Expect(limit.SummaryInterval).To(Equal(Duration(30 * time.Second)))
+			})
+
+			It("does not limit other tags", func() {
+				Expect(config.RateLimit("quiet-app")).To(BeNil())
+			})
+		})
+
+		It("rejects unknown severities", func() {
+			var config SyslogConfig
+			err := yaml.Unmarshal([]byte(`
+priorities:
+- tag: app1
+  severity: loud
+`), &config)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Include and Exclude", func() {
+		var config SyslogConfig
+
+		BeforeEach(func() {
+			config = SyslogConfig{}
+		})
+
+		It("includes .log files below tag directories by default", func() {
+			Expect(config.Included("app1/stdout.log")).To(BeTrue())
+			Expect(config.Included("app1/sub/deeper/stdout.log")).To(BeTrue())
+			Expect(config.Included("app1/stdout.log.1")).To(BeFalse())
+		})
+
+		It("includes files matching any configured pattern", func() {
+			config.Include = []string{"**/*.out", "*/**/*.log.json"}
+
+			Expect(config.Included("app1/stdout.out")).To(BeTrue())
+			Expect(config.Included("app1/sub/events.log.json")).To(BeTrue())
+			Expect(config.Included("app1/stdout.log")).To(BeFalse())
+		})
+
+		It("excludes files matching any exclude pattern", func() {
+			config.Exclude = []string{"**/debug.log"}
+
+			Expect(config.Excluded("app1/debug.log", false)).To(BeTrue())
+			Expect(config.Excluded("app1/sub/debug.log", false)).To(BeTrue())
+			Expect(config.Excluded("app1/stdout.log", false)).To(BeFalse())
+		})
+
+		It("prunes directories whose contents are all excluded", func() {
+			config.Exclude = []string{"app1/tmp/**", "**/cache"}
+
+			Expect(config.Excluded("app1/tmp", true)).To(BeTrue())
+			Expect(config.Excluded("app2/cache", true)).To(BeTrue())
+			Expect(config.Excluded("app1/logs", true)).To(BeFalse())
+		})
+	})
+
+	Describe("LoadConfig", func() {
+		var configPath string
+
+		writeConfig := func(config string) {
+			configFile, err := ioutil.TempFile("", "blackbox-config")
+			Expect(err).NotTo(HaveOccurred())
+			defer configFile.Close()
+
+			_, err = configFile.WriteString(config)
+			Expect(err).NotTo(HaveOccurred())
+
+			configPath = configFile.Name()
+		}
+
+		AfterEach(func() {
+			os.Remove(configPath)
+		})
+
+		It("accepts each watch mode", func() {
+			for _, mode := range []string{WatchModeAuto, WatchModeInotify, WatchModePoll} {
+				writeConfig(`
+syslog:
+  destination:
+    transport: tcp
+    address: 127.0.0.1:514
+  source_dir: /var/log
+  watch: ` + mode + `
+`)
+
+				config, err := LoadConfig(configPath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(config.Syslog.WatchMode()).To(Equal(mode))
+
+				os.Remove(configPath)
+			}
+		})
+
+		It("rejects an unknown watch mode", func() {
+			writeConfig(`
+syslog:
+  destination:
+    transport: tcp
+    address: 127.0.0.1:514
+  source_dir: /var/log
+  watch: fanotify
+`)
+
+			_, err := LoadConfig(configPath)
+			Expect(err).To(MatchError("unknown watch mode: fanotify"))
+		})
+	})
 })
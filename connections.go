@@ -0,0 +1,44 @@
+package blackbox
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/concourse/blackbox/syslog"
+)
+
+// Connections holds a Drainer open for as long as it runs, so that
+// destinations stay connected, and report as such, even while no files are
+// being tailed.
+//
+// As the last handle to the shared Drainer is only closed once it stops, it
+// should be stopped after the tailers; lines they queued are then flushed
+// for up to ShutdownGracePeriod, or DEFAULT_SHUTDOWN_GRACE_PERIOD if it is 0.
+type Connections struct {
+	DrainerFactory      syslog.DrainerFactory
+	ShutdownGracePeriod time.Duration
+}
+
+func (c *Connections) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	drainer, err := c.DrainerFactory.NewDrainer()
+	if err != nil {
+		return err
+	}
+
+	close(ready)
+
+	<-signals
+
+	gracePeriod := c.ShutdownGracePeriod
+	if gracePeriod <= 0 {
+		gracePeriod = DEFAULT_SHUTDOWN_GRACE_PERIOD
+	}
+
+	closed, err := closeBy(drainer, time.Now().Add(gracePeriod))
+	if !closed {
+		log.Println("shutdown grace period is over; not waiting for queued lines to be delivered")
+	}
+
+	return err
+}
@@ -0,0 +1,89 @@
+package blackbox
+
+import (
+	"log"
+	"sync"
+
+	"github.com/concourse/blackbox/syslog"
+)
+
+// deliveries tracks the lines that a tailer has handed to its Drainer until
+// their delivery results come back. Results can arrive out of order, so the
+// checkpoint only moves past a line once it and every line before it have
+// been settled.
+type deliveries struct {
+	path        string
+	checkpoints *Checkpoints
+
+	lock sync.Mutex
+
+	// first is the sequence number of pending[0].
+	first   uint64
+	pending []pendingLine
+
+	// stuck is set once a line could not be sent before the drainer was
+	// closed; it must be read again after a restart, so the checkpoint may
+	// not move past it.
+	stuck bool
+
+	failing bool
+}
+
+type pendingLine struct {
+	// checkpoint is nil if the file is not being checkpointed.
+	checkpoint *Checkpoint
+	settled    bool
+}
+
+// add tracks a line that is about to be drained, returning the function to
+// report its delivery result to.
+func (d *deliveries) add(checkpoint *Checkpoint) func(error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	seq := d.first + uint64(len(d.pending))
+	d.pending = append(d.pending, pendingLine{checkpoint: checkpoint})
+
+	return func(err error) {
+		d.settle(seq, err)
+	}
+}
+
+func (d *deliveries) settle(seq uint64, err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.report(err)
+
+	if err == syslog.ErrClosed {
+		d.stuck = true
+	}
+
+	d.pending[seq-d.first].settled = true
+
+	var latest *Checkpoint
+	for len(d.pending) > 0 && d.pending[0].settled && !d.stuck {
+		if d.pending[0].checkpoint != nil {
+			latest = d.pending[0].checkpoint
+		}
+
+		d.pending = d.pending[1:]
+		d.first++
+	}
+
+	if latest != nil && d.checkpoints != nil {
+		d.checkpoints.Set(d.path, *latest)
+	}
+}
+
+// report logs when lines from the file start failing to be delivered, and
+// when they are delivered again, rather than logging every failed line.
+func (d *deliveries) report(err error) {
+	if err != nil && !d.failing {
+		log.Printf("could not deliver lines from %s: %s\n", d.path, err)
+		d.failing = true
+	} else if err == nil && d.failing {
+		log.Printf("delivering lines from %s again\n", d.path)
+		d.failing = false
+	}
+}
@@ -5,106 +5,512 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"strings"
 	"time"
 
+	"github.com/concourse/blackbox/metrics"
 	"github.com/concourse/blackbox/syslog"
 	"github.com/tedsuo/ifrit/grouper"
+	"gopkg.in/fsnotify.v1"
 )
 
 const POLL_INTERVAL = 5 * time.Second
 
+// RESCAN_INTERVAL is how often the source dir is scanned when watching for
+// events, in case an event was missed.
+const RESCAN_INTERVAL = 1 * time.Minute
+
+// settle is how long to wait for further events before scanning, so that a
+// burst of changes results in a single scan.
+const settle = 100 * time.Millisecond
+
+// DEFAULT_REMOVAL_GRACE_PERIOD is how long a file must be gone before its
+// tailer is stopped, so that files being rotated are not mistaken for deleted
+// ones.
+const DEFAULT_REMOVAL_GRACE_PERIOD = 1 * time.Minute
+
+// DEFAULT_SHUTDOWN_GRACE_PERIOD is how long tailers are given to finish up
+// when blackbox is stopped.
+const DEFAULT_SHUTDOWN_GRACE_PERIOD = 10 * time.Second
+
+const (
+	WatchModeAuto    = "auto"
+	WatchModeInotify = "inotify"
+	WatchModePoll    = "poll"
+)
+
 type fileWatcher struct {
 	logger *log.Logger
 
-	sourceDir          string
+	config             SyslogConfig
 	dynamicGroupClient grouper.DynamicClient
 
 	drainerFactory syslog.DrainerFactory
+	checkpoints    *Checkpoints
+	health         *Health
+
+	// scanned is set once the files present at startup have been found;
+	// anything discovered after that is new and is read from the start.
+	scanned bool
+
+	// unscanned holds the directories that could not be scanned at startup.
+	// The files in them existed already, so they are read from the end once
+	// the directory can be scanned.
+	unscanned map[string]bool
+
+	waitingForSourceDir bool
+
+	// tailing holds every file that a tailer was started for, along with when
+	// it was first found to be missing (zero while it exists).
+	tailing map[string]time.Time
+
+	// seen holds the files found by the current scan, which is incomplete if
+	// it hit an error; files it did not see may then still exist.
+	seen       map[string]bool
+	incomplete bool
+
+	// rateLimiters holds the limiter for each rate limited tag, shared by the
+	// tailers of every file with that tag.
+	rateLimiters map[string]*RateLimiter
+
+	// events is nil when polling.
+	events  *fsnotify.Watcher
+	watched map[string]bool
 }
 
 func NewFileWatcher(
 	logger *log.Logger,
-	sourceDir string,
+	config SyslogConfig,
 	dynamicGroupClient grouper.DynamicClient,
 	drainerFactory syslog.DrainerFactory,
+	checkpoints *Checkpoints,
+	health *Health,
 ) *fileWatcher {
 	return &fileWatcher{
 		logger:             logger,
-		sourceDir:          sourceDir,
+		config:             config,
 		dynamicGroupClient: dynamicGroupClient,
 		drainerFactory:     drainerFactory,
+		checkpoints:        checkpoints,
+		health:             health,
+		tailing:            map[string]time.Time{},
+		unscanned:          map[string]bool{},
+		rateLimiters:       map[string]*RateLimiter{},
 	}
 }
 
 func (f *fileWatcher) Watch() {
+	f.countTailers()
+	f.startWatchingEvents()
+
 	for {
-		logDirs, err := ioutil.ReadDir(f.sourceDir)
-		if err != nil {
-			f.logger.Fatalf("could not list directories in source dir: %s\n", err)
+		f.scan()
+		f.waitForChanges()
+	}
+}
+
+// countTailers keeps the active tailers metric up to date as tailers start
+// and stop. It must be called before any are inserted into the group.
+func (f *fileWatcher) countTailers() {
+	entrances := f.dynamicGroupClient.EntranceListener()
+	exits := f.dynamicGroupClient.ExitListener()
+
+	go func() {
+		// the group waits for events to be received, so both are read until
+		// the group closes them
+		for entrances != nil || exits != nil {
+			select {
+			case _, ok := <-entrances:
+				if !ok {
+					entrances = nil
+					continue
+				}
+
+				metrics.ActiveTailers.Inc()
+			case _, ok := <-exits:
+				if !ok {
+					exits = nil
+					continue
+				}
+
+				metrics.ActiveTailers.Dec()
+			}
+		}
+	}()
+}
+
+// startWatchingEvents sets up inotify unless polling is configured or, in
+// auto mode, the source dir is on a filesystem that inotify cannot observe.
+func (f *fileWatcher) startWatchingEvents() {
+	mode := f.config.WatchMode()
+	if mode == WatchModePoll {
+		return
+	}
+
+	if mode == WatchModeAuto {
+		if supported, fsType := supportsEvents(f.config.SourceDir); !supported {
+			f.logger.Printf("source dir is on %s, which does not support events; polling\n", fsType)
+			return
 		}
+	}
+
+	events, err := fsnotify.NewWatcher()
+	if err != nil {
+		if mode == WatchModeInotify {
+			f.logger.Fatalf("could not watch for file events: %s\n", err)
+		}
+
+		f.logger.Printf("could not watch for file events, polling instead: %s\n", err)
+		return
+	}
+
+	f.events = events
+	f.watched = map[string]bool{}
+}
+
+func (f *fileWatcher) polling() bool {
+	return f.events == nil
+}
 
-		for _, logDir := range logDirs {
-			tag := logDir.Name()
-			tagDirPath := filepath.Join(f.sourceDir, tag)
+// waitForChanges returns once it is time to scan again: after the poll
+// interval when polling, or once something changes when watching events.
+func (f *fileWatcher) waitForChanges() {
+	heartbeat, stop := f.heartbeat()
+	defer stop()
 
-			fileInfo, err := os.Stat(tagDirPath)
-			if err != nil {
-				f.logger.Fatalf("failed to determine if path is directory: %s\n", err)
+	if f.polling() || f.waitingForSourceDir {
+		poll := time.After(POLL_INTERVAL)
+
+		for {
+			select {
+			case <-poll:
+				return
+			case <-heartbeat:
+				f.health.Waiting()
+			}
+		}
+	}
+
+	rescan := time.After(RESCAN_INTERVAL)
+
+	var removal <-chan time.Time
+	if wait, pending := f.untilNextRemoval(); pending {
+		removal = time.After(wait)
+	}
+
+	for {
+		select {
+		case event := <-f.events.Events:
+			if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+				// the kernel drops the watch along with the directory
+				delete(f.watched, event.Name)
 			}
 
-			if !fileInfo.IsDir() {
+			if event.Op&(fsnotify.Create|fsnotify.Remove|fsnotify.Rename) == 0 {
 				continue
 			}
 
-			f.findLogsToWatch(tag, tagDirPath, fileInfo)
+			f.settle()
+			return
+		case err := <-f.events.Errors:
+			f.scanFailed("error watching for file events: %s\n", err)
+			return
+		case <-rescan:
+			return
+		case <-removal:
+			return
+		case <-heartbeat:
+			f.health.Waiting()
+		}
+	}
+}
+
+// heartbeat ticks while the watch loop waits, so that it can report itself
+// alive to the health checks even when nothing changes for a long time.
+func (f *fileWatcher) heartbeat() (<-chan time.Time, func()) {
+	if f.health == nil {
+		return nil, func() {}
+	}
+
+	ticker := time.NewTicker(f.health.heartbeatInterval())
+
+	return ticker.C, ticker.Stop
+}
+
+// settle waits until no events have arrived for a little while.
+func (f *fileWatcher) settle() {
+	for {
+		select {
+		case event := <-f.events.Events:
+			if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+				delete(f.watched, event.Name)
+			}
+		case <-time.After(settle):
+			return
+		}
+	}
+}
+
+// watchDir starts watching a directory for new entries, if events are being
+// watched and it is not watched already.
+func (f *fileWatcher) watchDir(path string) {
+	if f.polling() || f.watched[path] {
+		return
+	}
+
+	if err := f.events.Add(path); err != nil {
+		f.scanFailed("could not watch %s for file events: %s\n", path, err)
+		return
+	}
+
+	f.watched[path] = true
+}
+
+// scan looks for log files that are not yet being tailed. Filesystem errors
+// are logged and the affected directory is skipped until the next scan, so
+// that one bad directory cannot stop every other file from being tailed.
+func (f *fileWatcher) scan() {
+	f.seen = map[string]bool{}
+	f.incomplete = false
+
+	logDirs, err := ioutil.ReadDir(f.config.SourceDir)
+	if os.IsNotExist(err) {
+		if !f.waitingForSourceDir {
+			f.logger.Printf("waiting for source dir %s to be created\n", f.config.SourceDir)
+			f.waitingForSourceDir = true
+		}
+
+		// anything that appears in it later is new
+		f.scanned = true
+		f.removeMissing()
+		f.reportScan(err)
+		return
+	}
+
+	if err != nil {
+		f.scanFailed("could not list directories in source dir: %s\n", err)
+		f.reportScan(err)
+		return
+	}
+
+	f.waitingForSourceDir = false
+	f.watchDir(f.config.SourceDir)
+
+	for _, logDir := range logDirs {
+		tag := logDir.Name()
+		tagDirPath := filepath.Join(f.config.SourceDir, tag)
+
+		fileInfo, err := os.Stat(tagDirPath)
+		if os.IsNotExist(err) {
+			// removed since the source dir was listed
+			delete(f.unscanned, tagDirPath)
+			continue
+		}
+
+		if err != nil {
+			f.scanFailed("skipping log dir '%s' (could not stat): %s\n", tag, err)
+
+			if !f.scanned {
+				f.unscanned[tagDirPath] = true
+			}
+
+			continue
+		}
 
+		if !fileInfo.IsDir() {
+			continue
 		}
 
-		time.Sleep(POLL_INTERVAL)
+		f.findLogsToWatch(tag, tagDirPath, fileInfo, f.scanned)
+	}
+
+	f.scanned = true
+	f.removeMissing()
+	f.reportScan(nil)
+}
+
+func (f *fileWatcher) reportScan(sourceDirErr error) {
+	if f.health != nil {
+		f.health.Scanned(sourceDirErr)
 	}
 }
 
-func (f *fileWatcher) findLogsToWatch(tag string, filePath string, file os.FileInfo) {
+// scanFailed reports an error that kept the scan from seeing every file.
+func (f *fileWatcher) scanFailed(format string, args ...interface{}) {
+	f.watchFailed(format, args...)
+	f.incomplete = true
+}
+
+func (f *fileWatcher) watchFailed(format string, args ...interface{}) {
+	f.logger.Printf(format, args...)
+	metrics.WatchErrors.Inc()
+}
+
+// removeMissing stops the tailers of files that the last scan did not find,
+// once they have been gone for the removal grace period.
+func (f *fileWatcher) removeMissing() {
+	if f.incomplete {
+		return
+	}
+
+	now := time.Now()
+
+	for path, missingSince := range f.tailing {
+		if f.seen[path] {
+			f.tailing[path] = time.Time{}
+			continue
+		}
+
+		if missingSince.IsZero() {
+			f.tailing[path] = now
+			continue
+		}
+
+		if now.Sub(missingSince) < f.removalGracePeriod() {
+			continue
+		}
+
+		f.logger.Printf("stopping tailer for %s (deleted)\n", path)
+
+		if process, found := f.dynamicGroupClient.Get(path); found {
+			process.Signal(os.Interrupt)
+		}
+
+		delete(f.tailing, path)
+	}
+}
+
+// untilNextRemoval returns how long it is until the grace period of the
+// first missing file runs out, if any are missing.
+func (f *fileWatcher) untilNextRemoval() (time.Duration, bool) {
+	var next time.Time
+
+	for _, missingSince := range f.tailing {
+		if missingSince.IsZero() {
+			continue
+		}
+
+		deadline := missingSince.Add(f.removalGracePeriod())
+		if next.IsZero() || deadline.Before(next) {
+			next = deadline
+		}
+	}
+
+	if next.IsZero() {
+		return 0, false
+	}
+
+	return time.Until(next), true
+}
+
+func (f *fileWatcher) removalGracePeriod() time.Duration {
+	if f.config.RemovalGracePeriod <= 0 {
+		return DEFAULT_REMOVAL_GRACE_PERIOD
+	}
+
+	return time.Duration(f.config.RemovalGracePeriod)
+}
+
+func (f *fileWatcher) shutdownGracePeriod() time.Duration {
+	if f.config.ShutdownGracePeriod <= 0 {
+		return DEFAULT_SHUTDOWN_GRACE_PERIOD
+	}
+
+	return time.Duration(f.config.ShutdownGracePeriod)
+}
+
+// findLogsToWatch starts tailing the log files at or under filePath. They
+// are new, and read from the start, if fromStart is set.
+func (f *fileWatcher) findLogsToWatch(tag string, filePath string, file os.FileInfo, fromStart bool) {
+	relPath, err := filepath.Rel(f.config.SourceDir, filePath)
+	if err != nil {
+		f.scanFailed("skipping '%s' (could not compute relative path): %s\n", filePath, err)
+		return
+	}
+
+	if f.config.Excluded(relPath, file.IsDir()) {
+		return
+	}
+
 	if !file.IsDir() {
-		if strings.HasSuffix(file.Name(), ".log") {
+		if f.config.Included(relPath) {
+			f.seen[filePath] = true
+
 			if _, found := f.dynamicGroupClient.Get(filePath); !found {
-				f.dynamicGroupClient.Inserter() <- f.memberForFile(filePath)
+				tag, err := f.config.Tag.Tag(relPath)
+				if err != nil {
+					// the file was seen, so this does not hold up removals
+					f.watchFailed("skipping '%s' (could not compute its tag): %s\n", filePath, err)
+					return
+				}
+
+				f.dynamicGroupClient.Inserter() <- f.memberForFile(filePath, relPath, tag, fromStart)
+				f.tailing[filePath] = time.Time{}
 			}
 		}
 		return
 	}
 
+	f.watchDir(filePath)
+
+	fromStart = fromStart && !f.unscanned[filePath]
+
 	dirContents, err := ioutil.ReadDir(filePath)
+	if os.IsNotExist(err) {
+		delete(f.unscanned, filePath)
+		return
+	}
+
 	if err != nil {
-		f.logger.Printf("skipping log dir '%s' (could not list files): %s\n", tag, err)
+		f.scanFailed("skipping log dir '%s' (could not list files): %s\n", filePath, err)
+
+		if !fromStart {
+			f.unscanned[filePath] = true
+		}
+
 		return
 	}
 
 	for _, content := range dirContents {
 		currentFilePath := filepath.Join(filePath, content.Name())
-		f.findLogsToWatch(tag, currentFilePath, content)
+		f.findLogsToWatch(tag, currentFilePath, content, fromStart)
 	}
+
+	delete(f.unscanned, filePath)
 }
 
-func (f *fileWatcher) memberForFile(logfilePath string) grouper.Member {
+func (f *fileWatcher) memberForFile(logfilePath string, relPath string, tag string, fromStart bool) grouper.Member {
 	drainer, err := f.drainerFactory.NewDrainer()
 	if err != nil {
 		f.logger.Fatalf("could not drain to syslog: %s\n", err)
 	}
 
-	logfileDir := filepath.Dir(logfilePath)
+	facility, severity := f.config.Priority(tag, relPath)
 
-	tag, err := filepath.Rel(f.sourceDir, logfileDir)
-	if err != nil {
-		f.logger.Fatalf("could not compute tag from file path %s: %s\n", logfilePath, err)
+	if limit := f.config.RateLimit(tag); limit != nil {
+		limiter, found := f.rateLimiters[tag]
+		if !found {
+			limiter = NewRateLimiter(tag, *limit)
+			f.rateLimiters[tag] = limiter
+		}
+
+		drainer = limiter.Drainer(drainer)
 	}
 
 	tailer := &Tailer{
-		Path:    logfilePath,
-		Tag:     tag,
-		Drainer: drainer,
+		Path:             logfilePath,
+		Tag:              tag,
+		Facility:         facility,
+		Severity:         severity,
+		SeverityPatterns: f.config.SeverityPatterns,
+		Multiline:        f.config.MultilineRule(tag),
+		JSON:             f.config.JSONRule(tag),
+		Drainer:          drainer,
+		FromStart:        fromStart,
+		Poll:             f.polling(),
+		Checkpoints:      f.checkpoints,
+
+		ShutdownGracePeriod: f.shutdownGracePeriod(),
 	}
 
-	return grouper.Member{tailer.Path, tailer}
+	return grouper.Member{Name: tailer.Path, Runner: tailer}
 }
@@ -0,0 +1,25 @@
+package blackbox
+
+import "syscall"
+
+// filesystems on which inotify does not see changes made by other hosts
+var filesystemsWithoutEvents = map[int64]string{
+	0x6969:     "nfs",
+	0xff534d42: "cifs",
+	0xfe534d42: "smb2",
+	0x517b:     "smb",
+	0x65735546: "fuse",
+	0x01021997: "9p",
+}
+
+// supportsEvents reports whether changes under path can be observed with
+// inotify, or whether the filesystem has to be polled.
+func supportsEvents(path string) (bool, string) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return true, ""
+	}
+
+	name, found := filesystemsWithoutEvents[int64(stat.Type)]
+	return !found, name
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package blackbox
+
+func supportsEvents(path string) (bool, string) {
+	return true, ""
+}
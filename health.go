@@ -0,0 +1,190 @@
+package blackbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/concourse/blackbox/syslog"
+)
+
+// DEFAULT_UNHEALTHY_AFTER is how long the watch loop may stall, or every
+// destination be down, before blackbox reports itself unhealthy.
+const DEFAULT_UNHEALTHY_AFTER = 5 * time.Minute
+
+// Health tracks whether blackbox is working, and explains why not at
+// /healthz and /readyz.
+type Health struct {
+	// Destinations returns the state of the destinations being written to.
+	Destinations func() []syslog.DestinationStatus
+
+	unhealthyAfter time.Duration
+	started        time.Time
+
+	lock         sync.Mutex
+	lastScan     time.Time
+	lastAlive    time.Time
+	sourceDirErr error
+}
+
+func NewHealth(unhealthyAfter time.Duration) *Health {
+	if unhealthyAfter <= 0 {
+		unhealthyAfter = DEFAULT_UNHEALTHY_AFTER
+	}
+
+	return &Health{
+		Destinations:   syslog.Statuses,
+		unhealthyAfter: unhealthyAfter,
+		started:        time.Now(),
+	}
+}
+
+// Scanned records that the watch loop scanned the source dir, along with why
+// the source dir could not be listed if it could not.
+func (h *Health) Scanned(sourceDirErr error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.lastScan = time.Now()
+	h.lastAlive = h.lastScan
+	h.sourceDirErr = sourceDirErr
+}
+
+// Waiting records that the watch loop is alive while it waits for something
+// to change, which may take longer than UnhealthyAfter when watching for
+// file events.
+func (h *Health) Waiting() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.lastAlive = time.Now()
+}
+
+// heartbeatInterval is how often the watch loop should call Waiting while it
+// waits.
+func (h *Health) heartbeatInterval() time.Duration {
+	return h.unhealthyAfter / 2
+}
+
+type healthCheck struct {
+	OK      bool   `json:"ok"`
+	Message string `json:"message"`
+}
+
+type healthReport struct {
+	OK           bool                       `json:"ok"`
+	Checks       map[string]healthCheck     `json:"checks"`
+	Destinations []syslog.DestinationStatus `json:"destinations"`
+}
+
+// ServeHealthz reports whether blackbox is alive: it fails if the watch loop
+// has stalled, or if every destination has been down for too long.
+func (h *Health) ServeHealthz(w http.ResponseWriter, r *http.Request) {
+	destinations := h.Destinations()
+
+	h.serve(w, destinations, map[string]healthCheck{
+		"watch":        h.watchCheck(),
+		"destinations": h.destinationsDownCheck(destinations),
+	})
+}
+
+// ServeReadyz reports whether blackbox is ready to forward lines: its config
+// was loaded, the source dir could be scanned and a destination is connected.
+func (h *Health) ServeReadyz(w http.ResponseWriter, r *http.Request) {
+	destinations := h.Destinations()
+
+	h.serve(w, destinations, map[string]healthCheck{
+		// there is nothing to serve this until it has been
+		"config":       {OK: true, Message: "loaded"},
+		"source_dir":   h.sourceDirCheck(),
+		"destinations": h.destinationsConnectedCheck(destinations),
+	})
+}
+
+func (h *Health) serve(w http.ResponseWriter, destinations []syslog.DestinationStatus, checks map[string]healthCheck) {
+	report := healthReport{
+		OK:           true,
+		Checks:       checks,
+		Destinations: destinations,
+	}
+
+	for _, check := range checks {
+		report.OK = report.OK && check.OK
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if report.OK {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(report)
+}
+
+func (h *Health) watchCheck() healthCheck {
+	h.lock.Lock()
+	lastScan := h.lastScan
+	lastAlive := h.lastAlive
+	h.lock.Unlock()
+
+	if lastScan.IsZero() {
+		if time.Since(h.started) > h.unhealthyAfter {
+			return healthCheck{Message: fmt.Sprintf("no scan has finished in the %s since starting", h.unhealthyAfter)}
+		}
+
+		return healthCheck{OK: true, Message: "waiting for the first scan"}
+	}
+
+	since := time.Since(lastScan)
+	if time.Since(lastAlive) > h.unhealthyAfter {
+		return healthCheck{Message: fmt.Sprintf("stalled: last scanned %s ago", since.Round(time.Second))}
+	}
+
+	return healthCheck{OK: true, Message: fmt.Sprintf("last scanned %s ago", since.Round(time.Second))}
+}
+
+func (h *Health) sourceDirCheck() healthCheck {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.lastScan.IsZero() {
+		return healthCheck{Message: "not scanned yet"}
+	}
+
+	if h.sourceDirErr != nil {
+		return healthCheck{Message: fmt.Sprintf("could not be scanned: %s", h.sourceDirErr)}
+	}
+
+	return healthCheck{OK: true, Message: "scanned"}
+}
+
+func (h *Health) destinationsConnectedCheck(destinations []syslog.DestinationStatus) healthCheck {
+	connected := 0
+	for _, destination := range destinations {
+		if destination.State == syslog.Connected {
+			connected++
+		}
+	}
+
+	message := fmt.Sprintf("%d of %d destinations connected", connected, len(destinations))
+
+	return healthCheck{OK: connected > 0, Message: message}
+}
+
+func (h *Health) destinationsDownCheck(destinations []syslog.DestinationStatus) healthCheck {
+	if len(destinations) == 0 {
+		return healthCheck{OK: true, Message: "no destinations"}
+	}
+
+	for _, destination := range destinations {
+		if destination.State == syslog.Connected || time.Since(destination.Since) <= h.unhealthyAfter {
+			return healthCheck{OK: true, Message: "not every destination has been down for long"}
+		}
+	}
+
+	return healthCheck{Message: fmt.Sprintf("every destination has been down for over %s", h.unhealthyAfter)}
+}
@@ -0,0 +1,136 @@
+package blackbox_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/concourse/blackbox"
+	"github.com/concourse/blackbox/syslog"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Health", func() {
+	type check struct {
+		OK      bool
+		Message string
+	}
+
+	type report struct {
+		OK     bool
+		Checks map[string]check
+	}
+
+	var (
+		health       *Health
+		destinations []syslog.DestinationStatus
+	)
+
+	BeforeEach(func() {
+		health = NewHealth(100 * time.Millisecond)
+
+		destinations = []syslog.DestinationStatus{
+			{Destination: "tcp://127.0.0.1:1234", State: syslog.Connected, Since: time.Now()},
+		}
+		health.Destinations = func() []syslog.DestinationStatus {
+			return destinations
+		}
+	})
+
+	get := func(serve http.HandlerFunc) (int, report) {
+		recorder := httptest.NewRecorder()
+		serve(recorder, httptest.NewRequest("GET", "/", nil))
+
+		Expect(recorder.Header().Get("Content-Type")).To(Equal("application/json"))
+
+		var result report
+		err := json.Unmarshal(recorder.Body.Bytes(), &result)
+		Expect(err).NotTo(HaveOccurred())
+
+		return recorder.Code, result
+	}
+
+	Describe("readiness", func() {
+		It("is not ready until the source dir has been scanned", func() {
+			code, result := get(health.ServeReadyz)
+			Expect(code).To(Equal(http.StatusServiceUnavailable))
+			Expect(result.OK).To(BeFalse())
+			Expect(result.Checks["source_dir"]).To(Equal(check{Message: "not scanned yet"}))
+
+			health.Scanned(nil)
+
+			code, result = get(health.ServeReadyz)
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(result.OK).To(BeTrue())
+			Expect(result.Checks).To(HaveKeyWithValue("config", check{OK: true, Message: "loaded"}))
+			Expect(result.Checks).To(HaveKeyWithValue("destinations", check{OK: true, Message: "1 of 1 destinations connected"}))
+		})
+
+		It("explains why the source dir could not be scanned", func() {
+			health.Scanned(errors.New("permission denied"))
+
+			code, result := get(health.ServeReadyz)
+			Expect(code).To(Equal(http.StatusServiceUnavailable))
+			Expect(result.Checks["source_dir"].OK).To(BeFalse())
+			Expect(result.Checks["source_dir"].Message).To(ContainSubstring("permission denied"))
+		})
+
+		It("is not ready while no destination is connected", func() {
+			health.Scanned(nil)
+			destinations[0].State = syslog.Disconnected
+
+			code, result := get(health.ServeReadyz)
+			Expect(code).To(Equal(http.StatusServiceUnavailable))
+			Expect(result.Checks["destinations"]).To(Equal(check{Message: "0 of 1 destinations connected"}))
+		})
+	})
+
+	Describe("liveness", func() {
+		It("is healthy while the watch loop is scanning and a destination is up", func() {
+			health.Scanned(nil)
+
+			code, result := get(health.ServeHealthz)
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(result.OK).To(BeTrue())
+		})
+
+		It("is unhealthy once the watch loop has stalled", func() {
+			health.Scanned(nil)
+			time.Sleep(200 * time.Millisecond)
+
+			code, result := get(health.ServeHealthz)
+			Expect(code).To(Equal(http.StatusServiceUnavailable))
+			Expect(result.Checks["watch"].OK).To(BeFalse())
+			Expect(result.Checks["watch"].Message).To(HavePrefix("stalled"))
+		})
+
+		It("stays healthy while the watch loop waits for changes for longer than that", func() {
+			health.Scanned(nil)
+			time.Sleep(60 * time.Millisecond)
+			health.Waiting()
+			time.Sleep(60 * time.Millisecond)
+
+			code, result := get(health.ServeHealthz)
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(result.Checks["watch"].Message).To(HavePrefix("last scanned"))
+		})
+
+		It("is unhealthy once every destination has been down for too long", func() {
+			health.Scanned(nil)
+			destinations[0].State = syslog.Disconnected
+
+			code, _ := get(health.ServeHealthz)
+			Expect(code).To(Equal(http.StatusOK))
+
+			destinations[0].Since = time.Now().Add(-time.Second)
+
+			code, result := get(health.ServeHealthz)
+			Expect(code).To(Equal(http.StatusServiceUnavailable))
+			Expect(result.Checks["destinations"].Message).To(Equal("every destination has been down for over 100ms"))
+		})
+	})
+})
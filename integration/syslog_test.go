@@ -3,9 +3,11 @@ package integration_test
 import (
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"time"
 
 	. "github.com/onsi/ginkgo"
@@ -18,6 +20,7 @@ import (
 	. "github.com/concourse/blackbox/integration"
 
 	sl "github.com/ziutek/syslog"
+	"gopkg.in/yaml.v2"
 
 	"github.com/concourse/blackbox"
 	"github.com/concourse/blackbox/syslog"
@@ -293,6 +296,30 @@ var _ = Describe("Blackbox", func() {
 			Expect(message.Content).To(ContainSubstring(Hostname()))
 		})
 
+		It("logs lines written to newly created files before they were discovered", func() {
+			config := buildConfig(logDir)
+			blackboxRunner.StartWithConfig(config, 1)
+
+			anotherLogFile, err := os.OpenFile(
+				filepath.Join(logDir, tagName, "another-tail.log"),
+				os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
+				os.ModePerm,
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer anotherLogFile.Close()
+
+			anotherLogFile.WriteString("written at startup\n")
+			anotherLogFile.Sync()
+
+			var message *sl.Message
+			Eventually(inbox.Messages, "15s").Should(Receive(&message))
+			Expect(message.Content).To(ContainSubstring("written at startup"))
+			Expect(message.Content).To(ContainSubstring("test-tag"))
+			Expect(message.Content).To(ContainSubstring(Hostname()))
+
+			blackboxRunner.Stop()
+		})
+
 		It("continues discovering new files after the original files get deleted", func() {
 			config := buildConfig(logDir)
 			blackboxRunner.StartWithConfig(config, 1)
@@ -368,6 +395,54 @@ var _ = Describe("Blackbox", func() {
 			blackboxRunner.Stop()
 		})
 
+		It("waits for the source directory to be created", func() {
+			sourceDir := filepath.Join(logDir, "not-yet-created")
+
+			config := buildConfig(sourceDir)
+			configPath := CreateConfigFile(config)
+			defer os.Remove(configPath)
+
+			session, err := gexec.Start(exec.Command(blackboxPath, "-config", configPath), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+
+			Eventually(session.Err, "5s").Should(gbytes.Say("waiting for source dir"))
+			Consistently(session).ShouldNot(gexec.Exit())
+
+			err = os.MkdirAll(filepath.Join(sourceDir, tagName), os.ModePerm)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = ioutil.WriteFile(filepath.Join(sourceDir, tagName, "tail.log"), []byte("hello\n"), os.ModePerm)
+			Expect(err).NotTo(HaveOccurred())
+
+			var message *sl.Message
+			Eventually(inbox.Messages, "15s").Should(Receive(&message))
+			Expect(message.Content).To(ContainSubstring("hello"))
+			Expect(message.Content).To(ContainSubstring("test-tag"))
+
+			session.Signal(os.Interrupt)
+			session.Wait()
+		})
+
+		It("stops tailing files that have been deleted", func() {
+			config := buildConfig(logDir)
+			config.Syslog.RemovalGracePeriod = blackbox.Duration(time.Second)
+			configPath := CreateConfigFile(config)
+			defer os.Remove(configPath)
+
+			session, err := gexec.Start(exec.Command(blackboxPath, "-config", configPath), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+
+			Eventually(session.Err, "5s").Should(gbytes.Say("Seeked"))
+
+			err = os.RemoveAll(filepath.Join(logDir, tagName))
+			Expect(err).NotTo(HaveOccurred())
+
+			Eventually(session.Err, "15s").Should(gbytes.Say("stopping tailer for .*tail.log"))
+
+			session.Signal(os.Interrupt)
+			session.Wait()
+		})
+
 		It("ignores files in source directory", func() {
 			err := ioutil.WriteFile(
 				filepath.Join(logDir, "not-a-tag-dir.log"),
@@ -393,6 +468,270 @@ var _ = Describe("Blackbox", func() {
 		})
 	})
 
+	Context("over tcp with a framing", func() {
+		var (
+			server        *TcpSyslogServer
+			serverProcess ifrit.Process
+			session       *gexec.Session
+		)
+
+		BeforeEach(func() {
+			server = &TcpSyslogServer{
+				Addr:          fmt.Sprintf("127.0.0.1:%d", 9190+GinkgoParallelNode()),
+				Messages:      make(chan string, 10),
+				FramingErrors: make(chan error, 10),
+			}
+		})
+
+		start := func(drain syslog.Drain) {
+			serverProcess = ginkgomon.Invoke(server)
+
+			drain.Transport = "tcp"
+			drain.Address = server.Addr
+
+			configPath := CreateConfigFile(blackbox.Config{
+				Syslog: blackbox.SyslogConfig{
+					Destination: drain,
+					SourceDir:   logDir,
+					Multiline: []blackbox.MultilineRule{{
+						Tag:          tagName,
+						Continuation: blackbox.Regexp{Regexp: regexp.MustCompile(`^\s`)},
+					}},
+				},
+			})
+
+			var err error
+			session, err = gexec.Start(exec.Command(blackboxPath, "-config", configPath), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+
+			Eventually(session.Err, "5s").Should(gbytes.Say("Seeked"))
+		}
+
+		AfterEach(func() {
+			session.Signal(os.Interrupt)
+			session.Wait()
+
+			ginkgomon.Interrupt(serverProcess)
+		})
+
+		writeStackTrace := func() {
+			logFile.WriteString("panic: oh no\n\tat main.go:12\nafter\n")
+			logFile.Sync()
+		}
+
+		It("sends multiline messages in a single octet-counted frame with rfc5424", func() {
+			server.Framing = syslog.FramingOctetCounting
+			start(syslog.Drain{Format: syslog.FormatRFC5424})
+
+			writeStackTrace()
+
+			var message string
+			Eventually(server.Messages, "5s").Should(Receive(&message))
+			Expect(message).To(HavePrefix("<14>1 "))
+			Expect(message).To(HaveSuffix(" panic: oh no\n\tat main.go:12"))
+
+			Consistently(server.FramingErrors).ShouldNot(Receive())
+		})
+
+		It("ends each message with the configured trailer with non-transparent framing", func() {
+			server.Framing = syslog.FramingNonTransparent
+			server.Trailer = "\x00"
+			start(syslog.Drain{
+				Format:  syslog.FormatRFC5424,
+				Framing: syslog.FramingNonTransparent,
+				Trailer: syslog.TrailerNUL,
+			})
+
+			writeStackTrace()
+
+			var message string
+			Eventually(server.Messages, "5s").Should(Receive(&message))
+			Expect(message).To(HaveSuffix(" panic: oh no\n\tat main.go:12"))
+
+			Consistently(server.FramingErrors).ShouldNot(Receive())
+		})
+	})
+
+	Context("watching for new files", func() {
+		var (
+			serverProcess ifrit.Process
+			session       *gexec.Session
+			buffer        *gbytes.Buffer
+		)
+
+		BeforeEach(func() {
+			buffer = gbytes.NewBuffer()
+		})
+
+		start := func(config blackbox.SyslogConfig) {
+			server := &TcpSyslogServer{
+				Addr:   fmt.Sprintf("127.0.0.1:%d", 9490+GinkgoParallelNode()),
+				Buffer: buffer,
+			}
+			serverProcess = ginkgomon.Invoke(server)
+
+			config.Destination = syslog.Drain{
+				Transport: "tcp",
+				Address:   server.Addr,
+			}
+			config.SourceDir = logDir
+
+			configPath := CreateConfigFile(blackbox.Config{Syslog: config})
+
+			var err error
+			session, err = gexec.Start(exec.Command(blackboxPath, "-config", configPath), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+
+			Eventually(session.Err, "5s").Should(gbytes.Say("Seeked"))
+		}
+
+		AfterEach(func() {
+			session.Signal(os.Interrupt)
+			session.Wait()
+
+			ginkgomon.Interrupt(serverProcess)
+		})
+
+		writeNestedFile := func() {
+			nestedDir := filepath.Join(logDir, "new-tag", "nested")
+			err := os.MkdirAll(nestedDir, os.ModePerm)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = ioutil.WriteFile(filepath.Join(nestedDir, "new.log"), []byte("hello from a new dir\n"), os.ModePerm)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		It("picks up files in new tag directories without waiting to poll", func() {
+			start(blackbox.SyslogConfig{Watch: blackbox.WatchModeAuto})
+
+			writeNestedFile()
+
+			Eventually(buffer, blackbox.POLL_INTERVAL/2).Should(gbytes.Say("new-tag.*hello from a new dir"))
+		})
+
+		It("finds new files on the next poll with watch set to poll", func() {
+			start(blackbox.SyslogConfig{Watch: blackbox.WatchModePoll})
+
+			writeNestedFile()
+
+			Consistently(buffer, blackbox.POLL_INTERVAL/2).ShouldNot(gbytes.Say("hello from a new dir"))
+			Eventually(buffer, blackbox.POLL_INTERVAL).Should(gbytes.Say("new-tag.*hello from a new dir"))
+		})
+
+		It("skips files whose tag cannot be computed and keeps tailing the rest", func() {
+			// files outside of test-tag are given an empty tag
+			var template blackbox.Template
+			err := yaml.Unmarshal([]byte(`"{{.app}}"`), &template)
+			Expect(err).NotTo(HaveOccurred())
+
+			start(blackbox.SyslogConfig{
+				Tag: blackbox.TagConfig{
+					Pattern:  blackbox.Regexp{Regexp: regexp.MustCompile(`^(?P<app>test-tag)/`)},
+					Template: template,
+				},
+			})
+
+			writeNestedFile()
+
+			Eventually(session.Err, "5s").Should(gbytes.Say("skipping '.*new.log' \\(could not compute its tag\\)"))
+
+			logFile.WriteString("hello\n")
+			logFile.Sync()
+
+			Eventually(buffer, "5s").Should(gbytes.Say("test-tag.*hello"))
+			Expect(session).NotTo(gexec.Exit())
+		})
+	})
+
+	Context("with an http address", func() {
+		var (
+			serverProcess ifrit.Process
+			session       *gexec.Session
+			httpAddress   string
+		)
+
+		BeforeEach(func() {
+			server := &TcpSyslogServer{
+				Addr:   fmt.Sprintf("127.0.0.1:%d", 9290+GinkgoParallelNode()),
+				Buffer: gbytes.NewBuffer(),
+			}
+			serverProcess = ginkgomon.Invoke(server)
+
+			httpAddress = fmt.Sprintf("127.0.0.1:%d", 9390+GinkgoParallelNode())
+
+			configPath := CreateConfigFile(blackbox.Config{
+				Syslog: blackbox.SyslogConfig{
+					Destination: syslog.Drain{
+						Transport: "tcp",
+						Address:   server.Addr,
+					},
+					SourceDir: logDir,
+				},
+				HTTP: blackbox.HTTPConfig{Address: httpAddress},
+			})
+
+			var err error
+			session, err = gexec.Start(exec.Command(blackboxPath, "-config", configPath), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+
+			Eventually(session.Err, "5s").Should(gbytes.Say("Seeked"))
+		})
+
+		AfterEach(func() {
+			session.Signal(os.Interrupt)
+			session.Wait()
+
+			ginkgomon.Interrupt(serverProcess)
+		})
+
+		scrape := func() string {
+			response, err := http.Get("http://" + httpAddress + "/metrics")
+			if err != nil {
+				return err.Error()
+			}
+			defer response.Body.Close()
+
+			body, err := ioutil.ReadAll(response.Body)
+			Expect(err).NotTo(HaveOccurred())
+
+			return string(body)
+		}
+
+		It("serves metrics about the lines being forwarded", func() {
+			logFile.WriteString("hello\n")
+			logFile.Sync()
+
+			Eventually(scrape, "5s").Should(ContainSubstring(`blackbox_lines_read_total{tag="test-tag"} 1`))
+			Eventually(scrape).Should(ContainSubstring(`blackbox_bytes_read_total{tag="test-tag"} 6`))
+			Eventually(scrape).Should(MatchRegexp(`blackbox_lines_sent_total{destination="tcp://127\.0\.0\.1:\d+",tag="test-tag"} 1`))
+			Expect(scrape()).To(ContainSubstring("blackbox_active_tailers 1"))
+		})
+
+		It("reports itself ready once a destination is connected, and healthy", func() {
+			ready := func() int {
+				response, err := http.Get("http://" + httpAddress + "/readyz")
+				if err != nil {
+					return 0
+				}
+				response.Body.Close()
+
+				return response.StatusCode
+			}
+
+			Eventually(ready, "5s").Should(Equal(http.StatusOK))
+
+			response, err := http.Get("http://" + httpAddress + "/healthz")
+			Expect(err).NotTo(HaveOccurred())
+			defer response.Body.Close()
+
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+			body, err := ioutil.ReadAll(response.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(body)).To(ContainSubstring(`"state":"connected"`))
+		})
+	})
+
 	Context("when the syslog server is not already running", func() {
 		var serverProcess ifrit.Process
 
@@ -407,8 +746,9 @@ var _ = Describe("Blackbox", func() {
 				Hostname: "",
 				Syslog: blackbox.SyslogConfig{
 					Destination: syslog.Drain{
-						Transport: "tcp",
-						Address:   address,
+						Transport:  "tcp",
+						Address:    address,
+						MaxBackoff: time.Second,
 					},
 					SourceDir: logDir,
 				},
@@ -421,7 +761,7 @@ var _ = Describe("Blackbox", func() {
 			session, err := gexec.Start(blackboxCmd, GinkgoWriter, GinkgoWriter)
 			Expect(err).NotTo(HaveOccurred())
 
-			time.Sleep(2 * syslog.ServerPollingInterval)
+			time.Sleep(5 * time.Second)
 
 			buffer := gbytes.NewBuffer()
 			serverProcess = ginkgomon.Invoke(&TcpSyslogServer{
@@ -443,7 +783,7 @@ var _ = Describe("Blackbox", func() {
 			logFile.WriteString("can't log this\n")
 			logFile.Sync()
 
-			time.Sleep(2 * syslog.ServerPollingInterval)
+			time.Sleep(5 * time.Second)
 
 			serverProcess = ginkgomon.Invoke(&TcpSyslogServer{
 				Addr:   address,
@@ -1,17 +1,31 @@
 package integration
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/onsi/gomega/gbytes"
+
+	"github.com/concourse/blackbox/syslog"
 )
 
 type TcpSyslogServer struct {
 	Addr   string
 	Buffer *gbytes.Buffer
+
+	// Framing, if set, is the RFC 6587 framing that every message must be
+	// sent with, followed by Trailer for non-transparent framing. Each frame
+	// is checked byte for byte, and the message in it is sent to Messages.
+	// Anything that does not match the framing is sent to FramingErrors.
+	Framing       string
+	Trailer       string
+	Messages      chan string
+	FramingErrors chan error
 }
 
 func (s *TcpSyslogServer) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
@@ -35,6 +49,11 @@ func (s *TcpSyslogServer) Run(signals <-chan os.Signal, ready chan<- struct{}) e
 				return
 			}
 
+			if s.Framing != "" {
+				go s.readFrames(conn)
+				continue
+			}
+
 			_, err = io.Copy(s.Buffer, conn)
 			if err != nil {
 				panic(err)
@@ -48,3 +67,95 @@ func (s *TcpSyslogServer) Run(signals <-chan os.Signal, ready chan<- struct{}) e
 
 	return nil
 }
+
+func (s *TcpSyslogServer) readFrames(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+
+	for {
+		var message string
+		var err error
+
+		switch s.Framing {
+		case syslog.FramingOctetCounting:
+			message, err = readOctetCountedFrame(reader)
+		case syslog.FramingNonTransparent:
+			message, err = readNonTransparentFrame(reader, s.Trailer)
+		default:
+			err = fmt.Errorf("unknown framing: %s", s.Framing)
+		}
+
+		if err == io.EOF {
+			return
+		}
+
+		if err == nil && !strings.HasPrefix(message, "<") {
+			err = fmt.Errorf("message does not start with a priority: %q", message)
+		}
+
+		if err != nil {
+			s.FramingErrors <- err
+			return
+		}
+
+		if s.Buffer != nil {
+			fmt.Fprintln(s.Buffer, message)
+		}
+
+		s.Messages <- message
+	}
+}
+
+// readOctetCountedFrame reads a frame of the form MSG-LEN SP SYSLOG-MSG,
+// where MSG-LEN is a number without leading zeros.
+func readOctetCountedFrame(reader *bufio.Reader) (string, error) {
+	prefix, err := reader.ReadString(' ')
+	if err == io.EOF && prefix == "" {
+		return "", io.EOF
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("incomplete frame length %q: %s", prefix, err)
+	}
+
+	digits := strings.TrimSuffix(prefix, " ")
+	length, err := strconv.Atoi(digits)
+	if err != nil || length <= 0 || strings.HasPrefix(digits, "0") || strings.HasPrefix(digits, "+") {
+		return "", fmt.Errorf("invalid frame length %q", digits)
+	}
+
+	message := make([]byte, length)
+	if _, err := io.ReadFull(reader, message); err != nil {
+		return "", fmt.Errorf("frame shorter than its length of %d: %s", length, err)
+	}
+
+	return string(message), nil
+}
+
+// readNonTransparentFrame reads a message up to and including the trailer,
+// which is a newline unless otherwise specified.
+func readNonTransparentFrame(reader *bufio.Reader, trailer string) (string, error) {
+	if trailer == "" {
+		trailer = "\n"
+	}
+
+	var frame []byte
+
+	for {
+		b, err := reader.ReadByte()
+		if err == io.EOF && len(frame) == 0 {
+			return "", io.EOF
+		}
+
+		if err != nil {
+			return "", fmt.Errorf("frame without a trailer %q: %s", frame, err)
+		}
+
+		frame = append(frame, b)
+
+		if strings.HasSuffix(string(frame), trailer) {
+			return strings.TrimSuffix(string(frame), trailer), nil
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package blackbox
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/concourse/blackbox/syslog"
+)
+
+// The fields of lager's JSON output, which JSON rules read by default.
+const (
+	DEFAULT_JSON_MESSAGE_FIELD   = "message"
+	DEFAULT_JSON_SEVERITY_FIELD  = "log_level"
+	DEFAULT_JSON_TIMESTAMP_FIELD = "timestamp"
+)
+
+// lagerSeverities maps lager's numeric log levels to severities.
+var lagerSeverities = []string{"debug", "info", "err", "crit"}
+
+// jsonLine is a line parsed by a JSON rule.
+type jsonLine struct {
+	// message is the whole line if it had no message field.
+	message string
+
+	// severity and time are nil and zero if the line did not have them.
+	severity *syslog.Severity
+	time     time.Time
+
+	// fields holds every other field, with nested objects flattened into
+	// dotted names such as "data.session".
+	fields map[string]string
+}
+
+// parse reads a line as a JSON object, returning false if it is not one.
+func (rule *JSONRule) parse(line string) (jsonLine, bool) {
+	decoder := json.NewDecoder(strings.NewReader(line))
+	decoder.UseNumber()
+
+	var object map[string]interface{}
+	if err := decoder.Decode(&object); err != nil || object == nil || decoder.More() {
+		return jsonLine{}, false
+	}
+
+	parsed := jsonLine{fields: map[string]string{}}
+
+	messageField := orDefault(rule.MessageField, DEFAULT_JSON_MESSAGE_FIELD)
+	value, hasMessage := object[messageField]
+	if hasMessage {
+		parsed.message = jsonValue(value)
+		delete(object, messageField)
+	} else {
+		// the whole line is sent instead, so its fields are not sent again
+		parsed.message = line
+	}
+
+	severityField := orDefault(rule.SeverityField, DEFAULT_JSON_SEVERITY_FIELD)
+	if severity, ok := jsonSeverity(object[severityField]); ok {
+		parsed.severity = &severity
+		delete(object, severityField)
+	}
+
+	timestampField := orDefault(rule.TimestampField, DEFAULT_JSON_TIMESTAMP_FIELD)
+	if timestamp, ok := jsonTime(object[timestampField]); ok {
+		parsed.time = timestamp
+		delete(object, timestampField)
+	}
+
+	if hasMessage {
+		flatten("", object, parsed.fields)
+	}
+
+	return parsed, true
+}
+
+func orDefault(value string, def string) string {
+	if value == "" {
+		return def
+	}
+
+	return value
+}
+
+// jsonSeverity reads a severity given by name, or as one of lager's numeric
+// log levels.
+func jsonSeverity(value interface{}) (syslog.Severity, bool) {
+	switch v := value.(type) {
+	case string:
+		severity, err := syslog.ParseSeverity(strings.ToLower(v))
+		return severity, err == nil
+	case json.Number:
+		level, err := v.Int64()
+		if err != nil || level < 0 || level >= int64(len(lagerSeverities)) {
+			return 0, false
+		}
+
+		severity, err := syslog.ParseSeverity(lagerSeverities[level])
+		return severity, err == nil
+	}
+
+	return 0, false
+}
+
+// jsonTime reads a timestamp in RFC 3339 format, or as seconds since the
+// epoch, which lager writes as a string.
+func jsonTime(value interface{}) (time.Time, bool) {
+	var seconds string
+
+	switch v := value.(type) {
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t, true
+		}
+
+		seconds = v
+	case json.Number:
+		seconds = v.String()
+	default:
+		return time.Time{}, false
+	}
+
+	return epochTime(seconds)
+}
+
+// epochTime parses seconds since the epoch, keeping every digit of a
+// fraction down to nanoseconds, which a float64 would not.
+func epochTime(seconds string) (time.Time, bool) {
+	whole, fraction := seconds, ""
+	if dot := strings.IndexByte(seconds, '.'); dot >= 0 {
+		whole, fraction = seconds[:dot], seconds[dot+1:]
+	}
+
+	sec, err := strconv.ParseUint(whole, 10, 63)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	if len(fraction) > 9 {
+		fraction = fraction[:9]
+	}
+
+	var nsec uint64
+	if fraction != "" {
+		nsec, err = strconv.ParseUint(fraction+strings.Repeat("0", 9-len(fraction)), 10, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+	}
+
+	return time.Unix(int64(sec), int64(nsec)), true
+}
+
+func flatten(prefix string, object map[string]interface{}, fields map[string]string) {
+	for name, value := range object {
+		if nested, ok := value.(map[string]interface{}); ok && len(nested) > 0 {
+			flatten(prefix+name+".", nested, fields)
+			continue
+		}
+
+		fields[prefix+name] = jsonValue(value)
+	}
+}
+
+// jsonValue renders a field's value as a string: strings as they are, and
+// anything else as JSON.
+func jsonValue(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+
+	buffer := &bytes.Buffer{}
+
+	encoder := json.NewEncoder(buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(value)
+
+	return strings.TrimSuffix(buffer.String(), "\n")
+}
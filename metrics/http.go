@@ -0,0 +1,13 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Handler serves every registered metric, in the Prometheus exposition
+// format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,130 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+const namespace = "blackbox"
+
+var (
+	LinesRead = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "lines_read_total",
+			Help:      "Number of lines read from log files, by tag.",
+		},
+		[]string{"tag"},
+	)
+
+	BytesRead = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "bytes_read_total",
+			Help:      "Number of bytes read from log files, by tag.",
+		},
+		[]string{"tag"},
+	)
+
+	LinesSent = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "lines_sent_total",
+			Help:      "Number of lines written to each destination, by tag.",
+		},
+		[]string{"tag", "destination"},
+	)
+
+	SendErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "send_errors_total",
+			Help:      "Number of failed attempts to write a line to each destination, by tag.",
+		},
+		[]string{"tag", "destination"},
+	)
+
+	Reconnects = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "reconnects_total",
+			Help:      "Number of times a connection to each destination was made again after being lost.",
+		},
+		[]string{"destination"},
+	)
+
+	ActiveTailers = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "active_tailers",
+			Help:      "Number of files being tailed.",
+		},
+	)
+
+	SpoolDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "spool_depth",
+			Help:      "Number of lines waiting in the on-disk spool to be replayed.",
+		},
+		[]string{"destination"},
+	)
+
+	Connections = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "destination_connections",
+			Help:      "Number of open connections to each destination.",
+		},
+		[]string{"destination"},
+	)
+
+	FailedLines = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "failed_lines_total",
+			Help:      "Number of lines that could not be delivered, by tag and destination.",
+		},
+		[]string{"tag", "destination"},
+	)
+
+	WatchErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "watch_errors_total",
+			Help:      "Number of filesystem errors encountered while looking for log files.",
+		},
+	)
+
+	SpoolDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "spool_dropped_lines_total",
+			Help:      "Number of lines dropped because the spool was full.",
+		},
+		[]string{"destination"},
+	)
+
+	RateLimitedLines = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rate_limited_lines_total",
+			Help:      "Number of lines dropped for exceeding their tag's rate limit.",
+		},
+		[]string{"tag"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(
+		LinesRead,
+		BytesRead,
+		LinesSent,
+		SendErrors,
+		Reconnects,
+		ActiveTailers,
+		WatchErrors,
+		SpoolDepth,
+		SpoolDropped,
+		Connections,
+		FailedLines,
+		RateLimitedLines,
+	)
+}
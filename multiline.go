@@ -0,0 +1,73 @@
+package blackbox
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_MULTILINE_MAX_LINES     = 500
+	DEFAULT_MULTILINE_FLUSH_TIMEOUT = 1 * time.Second
+)
+
+// multilineBuffer accumulates the lines of an event until it is complete.
+// Without a rule every line is its own event.
+type multilineBuffer struct {
+	rule  *MultilineRule
+	lines []string
+}
+
+func (b *multilineBuffer) continues(line string) bool {
+	if b.rule == nil || len(b.lines) == 0 {
+		return false
+	}
+
+	// a line matching Start always begins a new event, even if it also
+	// matches Continuation
+	if b.rule.Start.Regexp != nil && b.rule.Start.MatchString(line) {
+		return false
+	}
+
+	if b.rule.Continuation.Regexp != nil {
+		return b.rule.Continuation.MatchString(line)
+	}
+
+	return true
+}
+
+func (b *multilineBuffer) add(line string) {
+	b.lines = append(b.lines, line)
+}
+
+func (b *multilineBuffer) pending() bool {
+	return len(b.lines) > 0
+}
+
+// full reports whether the event should be sent without waiting for any
+// further lines.
+func (b *multilineBuffer) full() bool {
+	if b.rule == nil {
+		return true
+	}
+
+	maxLines := b.rule.MaxLines
+	if maxLines <= 0 {
+		maxLines = DEFAULT_MULTILINE_MAX_LINES
+	}
+
+	return len(b.lines) >= maxLines
+}
+
+func (b *multilineBuffer) flushTimeout() time.Duration {
+	if b.rule.FlushTimeout <= 0 {
+		return DEFAULT_MULTILINE_FLUSH_TIMEOUT
+	}
+
+	return time.Duration(b.rule.FlushTimeout)
+}
+
+func (b *multilineBuffer) take() string {
+	event := strings.Join(b.lines, "\n")
+	b.lines = nil
+	return event
+}
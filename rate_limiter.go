@@ -0,0 +1,253 @@
+package blackbox
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/concourse/blackbox/metrics"
+	"github.com/concourse/blackbox/syslog"
+)
+
+// DEFAULT_DROP_SUMMARY_INTERVAL is how often a rate limiter reports how many
+// lines it dropped, unless its RateLimit sets SummaryInterval.
+const DEFAULT_DROP_SUMMARY_INTERVAL = 10 * time.Second
+
+// RateLimiter enforces a RateLimit for a single tag. It is shared by the
+// tailers of every file with the tag, each of which drains through its own
+// Drainer wrapped by the limiter.
+type RateLimiter struct {
+	tag             string
+	summaryInterval time.Duration
+
+	lock  sync.Mutex
+	lines tokenBucket
+	bytes tokenBucket
+
+	// dropped counts the lines dropped since the last summary, which is sent
+	// with the facility of the latest of them.
+	dropped  int
+	facility syslog.Facility
+
+	// drainers are the open Drainers wrapped by the limiter. Summaries are
+	// sent through the oldest, and only while there is one.
+	drainers      []*rateLimitedDrainer
+	stopSummaries chan struct{}
+}
+
+func NewRateLimiter(tag string, limit RateLimit) *RateLimiter {
+	summaryInterval := time.Duration(limit.SummaryInterval)
+	if summaryInterval <= 0 {
+		summaryInterval = DEFAULT_DROP_SUMMARY_INTERVAL
+	}
+
+	now := time.Now()
+
+	return &RateLimiter{
+		tag:             tag,
+		summaryInterval: summaryInterval,
+		lines:           newTokenBucket(limit.LinesPerSecond, limit.BurstLines, now),
+		bytes:           newTokenBucket(limit.BytesPerSecond, limit.BurstBytes, now),
+	}
+}
+
+// Drainer wraps a tailer's Drainer so that the lines it drains count towards
+// the limit, and are dropped once they exceed it.
+func (l *RateLimiter) Drainer(drainer syslog.Drainer) syslog.Drainer {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	wrapped := &rateLimitedDrainer{
+		Drainer: drainer,
+		limiter: l,
+		closing: make(chan struct{}),
+	}
+
+	l.drainers = append(l.drainers, wrapped)
+	if len(l.drainers) == 1 {
+		l.stopSummaries = make(chan struct{})
+		go l.sendSummaries(l.stopSummaries)
+	}
+
+	return wrapped
+}
+
+func (l *RateLimiter) allow(message syslog.Message) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	l.lines.refill(now)
+	l.bytes.refill(now)
+
+	// the newline counts, as it does towards the bytes read
+	size := float64(len(message.Line) + 1)
+
+	if !l.lines.has(1) || !l.bytes.has(size) {
+		l.dropped++
+		l.facility = message.Facility
+		return false
+	}
+
+	l.lines.take(1)
+	l.bytes.take(size)
+
+	return true
+}
+
+func (l *RateLimiter) sendSummaries(stop <-chan struct{}) {
+	ticker := time.NewTicker(l.summaryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			l.lock.Lock()
+			if len(l.drainers) == 0 || l.dropped == 0 {
+				l.lock.Unlock()
+				continue
+			}
+
+			drainer := l.drainers[0]
+			summary := l.summary()
+
+			// the drainer is not closed until the summary is sent, and
+			// closing it aborts the summary
+			drainer.summarizing.Add(1)
+			l.lock.Unlock()
+
+			summary.Abort = drainer.closing
+			drainer.Drainer.Drain(summary)
+
+			drainer.summarizing.Done()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// summary returns a message saying how many lines were dropped, and starts
+// counting again. It must be called with the lock held. The message is sent
+// once the lock is released, as the Drainer may block while its queue is
+// full, and tailers would otherwise block with it in allow.
+func (l *RateLimiter) summary() syslog.Message {
+	summary := syslog.Message{
+		Line:     fmt.Sprintf("blackbox: dropped %d lines for tag %s", l.dropped, l.tag),
+		Tag:      l.tag,
+		Facility: l.facility,
+		Severity: syslog.WarningSeverity,
+	}
+
+	l.dropped = 0
+
+	return summary
+}
+
+// release forgets a Drainer that is being closed. The last one to go sends a
+// final summary, so that no drops go unreported, if there is room for it in
+// the queue.
+func (l *RateLimiter) release(drainer *rateLimitedDrainer) {
+	l.lock.Lock()
+
+	for i, d := range l.drainers {
+		if d == drainer {
+			l.drainers = append(l.drainers[:i], l.drainers[i+1:]...)
+			break
+		}
+	}
+
+	var final *syslog.Message
+	if len(l.drainers) == 0 {
+		close(l.stopSummaries)
+
+		if l.dropped > 0 {
+			summary := l.summary()
+			final = &summary
+		}
+	}
+
+	l.lock.Unlock()
+
+	close(drainer.closing)
+	drainer.summarizing.Wait()
+
+	if final != nil {
+		final.Abort = drainer.closing
+		drainer.Drainer.Drain(*final)
+	}
+}
+
+type rateLimitedDrainer struct {
+	syslog.Drainer
+
+	limiter   *RateLimiter
+	closeOnce sync.Once
+
+	// closing is closed once the drainer is released, which aborts any
+	// summary being sent through it.
+	closing     chan struct{}
+	summarizing sync.WaitGroup
+}
+
+func (d *rateLimitedDrainer) Drain(message syslog.Message) error {
+	if !d.limiter.allow(message) {
+		metrics.RateLimitedLines.WithLabelValues(d.limiter.tag).Inc()
+
+		// the line was dropped on purpose, so it is settled rather than
+		// failed; it must not be read again after a restart
+		if message.Done != nil {
+			message.Done(nil)
+		}
+
+		return nil
+	}
+
+	return d.Drainer.Drain(message)
+}
+
+func (d *rateLimitedDrainer) Close() error {
+	d.closeOnce.Do(func() {
+		d.limiter.release(d)
+	})
+
+	return d.Drainer.Close()
+}
+
+// tokenBucket holds up to burst tokens, and is refilled at rate tokens per
+// second. A rate of 0 means there is no limit.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) tokenBucket {
+	b := tokenBucket{rate: rate, burst: float64(burst), last: now}
+	if b.burst <= 0 {
+		b.burst = math.Max(rate, 1)
+	}
+
+	b.tokens = b.burst
+
+	return b
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// has reports whether n tokens may be taken. Anything bigger than the burst
+// may be taken once the bucket is full, leaving it in debt, so that it is
+// not dropped forever.
+func (b *tokenBucket) has(n float64) bool {
+	return b.rate == 0 || b.tokens >= math.Min(n, b.burst)
+}
+
+func (b *tokenBucket) take(n float64) {
+	if b.rate > 0 {
+		b.tokens -= n
+	}
+}
@@ -0,0 +1,180 @@
+package blackbox_test
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	. "github.com/concourse/blackbox"
+	"github.com/concourse/blackbox/metrics"
+	"github.com/concourse/blackbox/syslog"
+	"github.com/concourse/blackbox/syslog/syslogfakes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RateLimiter", func() {
+	var (
+		limit   RateLimit
+		limiter *RateLimiter
+		inner   *syslogfakes.FakeDrainer
+		drainer syslog.Drainer
+	)
+
+	drained := func() []string {
+		lines := []string{}
+		for i := 0; i < inner.DrainCallCount(); i++ {
+			lines = append(lines, inner.DrainArgsForCall(i).Line)
+		}
+		return lines
+	}
+
+	send := func(drainer syslog.Drainer, lines ...string) {
+		for _, line := range lines {
+			drainer.Drain(syslog.Message{Line: line, Tag: "app1"})
+		}
+	}
+
+	BeforeEach(func() {
+		limit = RateLimit{
+			Tag:             "app1",
+			LinesPerSecond:  10,
+			BurstLines:      2,
+			SummaryInterval: Duration(time.Hour),
+		}
+
+		inner = new(syslogfakes.FakeDrainer)
+	})
+
+	JustBeforeEach(func() {
+		limiter = NewRateLimiter("app1", limit)
+		drainer = limiter.Drainer(inner)
+	})
+
+	AfterEach(func() {
+		drainer.Close()
+	})
+
+	It("lets a burst of lines through and drops the rest", func() {
+		droppedBefore := testutil.ToFloat64(metrics.RateLimitedLines.WithLabelValues("app1"))
+
+		send(drainer, "one", "two", "three")
+		Expect(drained()).To(Equal([]string{"one", "two"}))
+
+		Expect(testutil.ToFloat64(metrics.RateLimitedLines.WithLabelValues("app1")) - droppedBefore).To(Equal(1.0))
+	})
+
+	It("settles dropped lines successfully, so that they are checkpointed", func() {
+		send(drainer, "one", "two")
+
+		var result error = syslog.ErrClosed
+		drainer.Drain(syslog.Message{Line: "three", Tag: "app1", Done: func(err error) {
+			result = err
+		}})
+
+		Expect(result).NotTo(HaveOccurred())
+	})
+
+	It("lets lines through again as the bucket refills", func() {
+		send(drainer, "one", "two", "three")
+		time.Sleep(150 * time.Millisecond)
+		send(drainer, "four")
+
+		Expect(drained()).To(Equal([]string{"one", "two", "four"}))
+	})
+
+	Context("with a byte limit", func() {
+		BeforeEach(func() {
+			limit = RateLimit{
+				Tag:             "app1",
+				BytesPerSecond:  1,
+				BurstBytes:      10,
+				SummaryInterval: Duration(time.Hour),
+			}
+		})
+
+		It("limits lines by their size, including the newline", func() {
+			send(drainer, "1234", "1234", "1")
+			Expect(drained()).To(Equal([]string{"1234", "1234"}))
+		})
+
+		It("lets a line bigger than the burst through once the bucket is full", func() {
+			send(drainer, strings.Repeat("x", 20), "1")
+			Expect(drained()).To(Equal([]string{strings.Repeat("x", 20)}))
+		})
+	})
+
+	It("shares the limit between every drainer it wraps", func() {
+		other := limiter.Drainer(new(syslogfakes.FakeDrainer))
+		defer other.Close()
+
+		send(other, "one", "two")
+		send(drainer, "three")
+
+		Expect(drained()).To(BeEmpty())
+	})
+
+	Context("with a short summary interval", func() {
+		BeforeEach(func() {
+			limit.SummaryInterval = Duration(100 * time.Millisecond)
+		})
+
+		It("periodically sends how many lines were dropped", func() {
+			send(drainer, "one", "two", "three", "four")
+
+			Eventually(drained).Should(ContainElement("blackbox: dropped 2 lines for tag app1"))
+
+			summary := inner.DrainArgsForCall(inner.DrainCallCount() - 1)
+			Expect(summary.Tag).To(Equal("app1"))
+			Expect(summary.Severity).To(Equal(syslog.WarningSeverity))
+
+			Consistently(inner.DrainCallCount, "300ms").Should(Equal(3))
+		})
+
+		Context("when the drainer's queue is full", func() {
+			BeforeEach(func() {
+				inner.DrainStub = func(message syslog.Message) error {
+					if strings.HasPrefix(message.Line, "blackbox: dropped") {
+						<-message.Abort
+						return syslog.ErrClosed
+					}
+
+					return nil
+				}
+			})
+
+			It("keeps letting lines through, and gives up on the summary once closed", func() {
+				send(drainer, "one", "two", "three")
+
+				Eventually(drained).Should(ContainElement("blackbox: dropped 1 lines for tag app1"))
+
+				time.Sleep(150 * time.Millisecond)
+
+				sent := make(chan struct{})
+				go func() {
+					send(drainer, "four")
+					close(sent)
+				}()
+				Eventually(sent).Should(BeClosed())
+				Expect(drained()).To(ContainElement("four"))
+
+				closed := make(chan struct{})
+				go func() {
+					drainer.Close()
+					close(closed)
+				}()
+				Eventually(closed).Should(BeClosed())
+			})
+		})
+	})
+
+	It("sends a final summary when the last drainer is closed", func() {
+		send(drainer, "one", "two", "three")
+		drainer.Close()
+
+		Expect(drained()).To(Equal([]string{"one", "two", "blackbox: dropped 1 lines for tag app1"}))
+		Expect(inner.CloseCallCount()).To(Equal(1))
+	})
+})
@@ -0,0 +1,35 @@
+package syslog
+
+import (
+	"math/rand"
+	"time"
+)
+
+// initialBackoff is how long to wait before the first retry.
+const initialBackoff = 100 * time.Millisecond
+
+// backoff computes how long to wait before each retry, doubling the wait
+// every time up to max. Each wait is jittered so that many connections
+// failing at once do not all retry at the same moment.
+type backoff struct {
+	max      time.Duration
+	attempts uint
+}
+
+// next returns how long to wait before the next retry.
+func (b *backoff) next() time.Duration {
+	wait := b.max
+	if b.attempts < 32 && initialBackoff<<b.attempts < b.max {
+		wait = initialBackoff << b.attempts
+	}
+
+	b.attempts++
+
+	// anywhere between half and all of the wait
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// reset starts over from the initial wait, once a retry has succeeded.
+func (b *backoff) reset() {
+	b.attempts = 0
+}
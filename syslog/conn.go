@@ -0,0 +1,72 @@
+package syslog
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	ConnectTimeout = 30 * time.Second
+	WriteTimeout   = 30 * time.Second
+
+	tcpMaxLineLength = 99990
+)
+
+// conn is a connection to a syslog server over one of the supported
+// transports: "udp", "tcp" or "tls".
+type conn struct {
+	net.Conn
+
+	transport string
+}
+
+func dial(endpoint endpoint) (*conn, error) {
+	drain := endpoint.drain
+
+	var netConn net.Conn
+	var err error
+
+	switch drain.Transport {
+	case "udp", "tcp":
+		netConn, err = net.DialTimeout(drain.Transport, drain.Address, ConnectTimeout)
+	case "tls":
+		netConn, err = tls.DialWithDialer(
+			&net.Dialer{Timeout: ConnectTimeout},
+			"tcp",
+			drain.Address,
+			endpoint.tlsConfig,
+		)
+	default:
+		err = fmt.Errorf("unknown syslog transport: %s", drain.Transport)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &conn{
+		Conn:      netConn,
+		transport: drain.Transport,
+	}, nil
+}
+
+func (c *conn) writePacket(packet packet, formatter formatter) error {
+	err := c.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range formatter.messages(packet) {
+		if c.transport != "udp" {
+			msg = formatter.frame(msg)
+		}
+
+		if _, err := c.Write([]byte(msg)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
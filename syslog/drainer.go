@@ -1,74 +1,853 @@
 package syslog
 
 import (
+	"crypto/tls"
 	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	sl "github.com/papertrail/remote_syslog2/syslog"
+
+	"github.com/concourse/blackbox/metrics"
 )
 
 type Drain struct {
 	Transport string `yaml:"transport"`
 	Address   string `yaml:"address"`
+
+	// TLS configures the "tls" transport.
+	TLS TLSConfig `yaml:"tls,omitempty"`
+
+	// Format is the message format: "rfc5424", "rfc3164", or empty for
+	// remote_syslog2's format.
+	Format         string         `yaml:"format,omitempty"`
+	StructuredData StructuredData `yaml:"structured_data,omitempty"`
+
+	// ProcID and MsgID are sent as the PROCID and MSGID of rfc5424 messages,
+	// which are "-" when they are empty. The process that wrote a line is not
+	// known, so ProcID is a fixed value such as the name of the job.
+	ProcID string `yaml:"procid,omitempty"`
+	MsgID  string `yaml:"msgid,omitempty"`
+
+	// Framing delimits messages sent over "tcp" and "tls": "octet_counting",
+	// the default for rfc5424, or "non_transparent", the default otherwise,
+	// which ends each message with Trailer ("lf", "crlf" or "nul").
+	Framing string `yaml:"framing,omitempty"`
+	Trailer string `yaml:"trailer,omitempty"`
+
+	// MaxMessageBytes caps the size of each message, not counting its
+	// framing. Oversize is what happens to a line that makes a message any
+	// bigger: it is truncated (the default), split across several messages,
+	// or dropped. Over "tcp" and "tls", messages are always truncated at
+	// 99990 bytes.
+	MaxMessageBytes int    `yaml:"max_message_bytes,omitempty"`
+	Oversize        string `yaml:"oversize,omitempty"`
+
+	// Failover lists destinations to switch to, in order, once this one has
+	// failed FailoverAfter times in a row. While failed over, this
+	// destination is probed every FailbackInterval and switched back to as
+	// soon as it accepts a connection.
+	Failover         []Drain       `yaml:"failover,omitempty"`
+	FailoverAfter    int           `yaml:"failover_after,omitempty"`
+	FailbackInterval time.Duration `yaml:"failback_interval,omitempty"`
+
+	// OnFailure is what happens to a line that cannot be written: it is
+	// retried until it can be, spooled to disk, or dropped. The default is to
+	// spool if Spool is configured and to retry otherwise.
+	OnFailure string `yaml:"on_failure,omitempty"`
+
+	// Spool configures where lines are held on disk while the destination
+	// cannot be written to, for the spool policy.
+	Spool *SpoolConfig `yaml:"spool,omitempty"`
+
+	// Connections is how many connections lines are written over
+	// concurrently. Lines are only guaranteed to arrive in order when there
+	// is just one, the default.
+	Connections int `yaml:"connections,omitempty"`
+
+	// MaxBackoff caps how long to wait between attempts to reconnect. The
+	// wait starts short and doubles after every failed attempt.
+	MaxBackoff time.Duration `yaml:"max_backoff,omitempty"`
+}
+
+// Message is a single line to be forwarded, along with the tag and priority
+// it should be sent with.
+type Message struct {
+	Line     string
+	Tag      string
+	Severity Severity
+	Facility Facility
+
+	// Path is the file the line was read from.
+	Path string
+
+	// Time is when the line was logged, if it said; otherwise it is sent
+	// with the time it was drained.
+	Time time.Time
+
+	// Fields are sent along with the line: as structured data in the rfc5424
+	// format, and appended to the line as key=value pairs otherwise.
+	Fields map[string]string
+
+	// Abort, if set, makes Drain give up once it is closed rather than wait
+	// for room in a full queue. Drain then returns ErrClosed, which is also
+	// reported to Done. A line is still queued if there is room, so an Abort
+	// that is already closed only keeps Drain from blocking.
+	Abort <-chan struct{}
+
+	// Done, if set, is called exactly once with the line's delivery result:
+	// nil once it has been written or spooled, or the error that it finally
+	// failed with. It is called even if Drain returns an error, and may be
+	// called from another goroutine.
+	Done func(err error)
+}
+
+// done reports the message's delivery result, if anyone is waiting for it.
+func (message Message) done(err error) {
+	if message.Done != nil {
+		message.Done(err)
+	}
 }
 
 //go:generate counterfeiter . Drainer
 
 type Drainer interface {
-	Drain(line string, tag string) error
+	// Drain queues a line to be written. It returns an error if the line was
+	// not queued; the line's delivery result is reported to its Done.
+	Drain(message Message) error
+
+	// Close sends any lines that are still queued and releases the
+	// connection. Drain must not be called once a Drainer is closed.
+	Close() error
+}
+
+const (
+	OnFailureRetry = "retry"
+	OnFailureSpool = "spool"
+	OnFailureDrop  = "drop"
+)
+
+const (
+	DefaultFailoverAfter    = 3
+	DefaultFailbackInterval = 30 * time.Second
+	DefaultMaxBackoff       = 30 * time.Second
+)
+
+// ConnState is the state of a drainer's connection to its destination.
+type ConnState int32
+
+const (
+	// Connecting is the state until the first attempt to connect is over.
+	Connecting ConnState = iota
+	Connected
+	// Disconnected is the state after an attempt to connect or write has
+	// failed, while waiting to try again.
+	Disconnected
+)
+
+func (state ConnState) String() string {
+	switch state {
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	case Disconnected:
+		return "disconnected"
+	default:
+		return fmt.Sprintf("ConnState(%d)", int32(state))
+	}
+}
+
+func (state ConnState) MarshalText() ([]byte, error) {
+	return []byte(state.String()), nil
 }
 
-const ServerPollingInterval = 5 * time.Second
+// ErrClosed is reported for lines that were still waiting to be written when
+// the drainer was closed, or that were aborted before they could be queued.
+var ErrClosed = errors.New("drainer closed before the line could be written")
 
+// errBackingOff is reported for lines dropped without trying to write them,
+// because an earlier attempt failed recently.
+var errBackingOff = errors.New("destination is unreachable; waiting to retry")
+
+var errTooBig = errors.New("line is bigger than max_message_bytes")
+
+// queueSize is how many lines can be waiting to be written before Drain
+// blocks. The queue is shared by every tailer writing to the destination.
+const queueSize = 1000
+
+func (drain Drain) String() string {
+	return drain.Transport + "://" + drain.Address
+}
+
+// endpoint is an address that a drainer can connect to: the destination
+// itself or one of its failovers.
+type endpoint struct {
+	drain     Drain
+	tlsConfig *tls.Config
+}
+
+// onFailure returns the drain's failure policy.
+func (drain Drain) onFailure() (string, error) {
+	switch drain.OnFailure {
+	case "":
+		if drain.Spool != nil {
+			return OnFailureSpool, nil
+		}
+
+		return OnFailureRetry, nil
+	case OnFailureSpool:
+		if drain.Spool == nil {
+			return "", fmt.Errorf("on_failure is %s but no spool is configured", OnFailureSpool)
+		}
+
+		return OnFailureSpool, nil
+	case OnFailureRetry, OnFailureDrop:
+		if drain.Spool != nil {
+			return "", fmt.Errorf("spool is configured but on_failure is %s", drain.OnFailure)
+		}
+
+		return drain.OnFailure, nil
+	default:
+		return "", fmt.Errorf("unknown on_failure policy: %s", drain.OnFailure)
+	}
+}
+
+// validate checks the drain's configuration without connecting.
+func (drain Drain) validate() error {
+	if _, err := drain.onFailure(); err != nil {
+		return err
+	}
+
+	if _, err := newFormatter(drain); err != nil {
+		return err
+	}
+
+	_, err := drain.endpoints()
+	return err
+}
+
+// endpoints validates the drain's configuration, returning the destination
+// followed by each of its failovers.
+func (drain Drain) endpoints() ([]endpoint, error) {
+	var endpoints []endpoint
+
+	for _, d := range append([]Drain{drain}, drain.Failover...) {
+		var tlsConfig *tls.Config
+
+		switch d.Transport {
+		case "udp", "tcp":
+		case "tls":
+			var err error
+			tlsConfig, err = d.TLS.Config()
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unknown syslog transport: %s", d.Transport)
+		}
+
+		endpoints = append(endpoints, endpoint{
+			drain:     d,
+			tlsConfig: tlsConfig,
+		})
+	}
+
+	return endpoints, nil
+}
+
+// drainer writes to a destination over one or more connections, each of
+// which is written to by its own worker. Every worker takes lines from the
+// same queue, so a drainer can be shared by any number of tailers.
 type drainer struct {
-	logger   *sl.Logger
 	hostname string
+	workers  []*worker
+
+	packets chan delivery
+
+	// spool is released once the workers that use it have stopped.
+	spool *spool
+
+	closeOnce   sync.Once
+	closing     chan struct{}
+	stopped     sync.WaitGroup
+	releaseOnce sync.Once
+}
+
+// delivery is a line waiting in the queue, along with who to tell once it has
+// been delivered.
+type delivery struct {
+	packet packet
+	done   func(err error)
+}
+
+// worker writes lines from the queue over a single connection, failing over
+// and handling failed lines as configured.
+type worker struct {
+	destination      string
+	onFailure        string
+	endpoints        []endpoint
+	failoverAfter    int
+	failbackInterval time.Duration
+
+	// active is the index of the endpoint currently being written to, and
+	// failures the number of times in a row that it has failed.
+	active   int
+	failures int
+
+	// probed receives a connection to the primary endpoint while failed over.
+	// The primary is probed in the background, so that one that is slow to
+	// refuse connections does not hold up writes to the endpoint in use.
+	probing   bool
+	probed    chan *conn
+	stopProbe chan struct{}
+
+	conn      *conn
+	formatter formatter
+	state     int32
+
+	// connected is set once the worker has been connected, after which
+	// connecting again counts as a reconnect.
+	connected bool
+	backoff   backoff
+
+	// spool is shared by every worker, but only the one that replays reads
+	// from it so that each spooled line is sent once.
+	spool      *spool
+	replays    bool
+	nextReplay time.Time
+
+	// nextAttempt is when to next try to connect, for the drop policy.
+	nextAttempt time.Time
+
+	packets <-chan delivery
+	closing <-chan struct{}
 }
 
 func NewDrainer(drain Drain, hostname string) (*drainer, error) {
-	err := errors.New("non-nil")
-	var logger *sl.Logger
-
-	for err != nil {
-		logger, err = sl.Dial(
-			hostname,
-			drain.Transport,
-			drain.Address,
-			nil,
-			30*time.Second,
-			30*time.Second,
-			99990,
-		)
+	onFailure, err := drain.onFailure()
+	if err != nil {
+		return nil, err
+	}
 
-		if err != nil {
-			time.Sleep(ServerPollingInterval)
-		}
+	endpoints, err := drain.endpoints()
+	if err != nil {
+		return nil, err
 	}
 
+	formatter, err := newFormatter(drain)
 	if err != nil {
 		return nil, err
 	}
 
-	return &drainer{
-		logger:   logger,
+	d := &drainer{
 		hostname: hostname,
-	}, nil
+
+		packets: make(chan delivery, queueSize),
+
+		closing: make(chan struct{}),
+	}
+
+	failoverAfter := drain.FailoverAfter
+	if failoverAfter <= 0 {
+		failoverAfter = DefaultFailoverAfter
+	}
+
+	failbackInterval := drain.FailbackInterval
+	if failbackInterval <= 0 {
+		failbackInterval = DefaultFailbackInterval
+	}
+
+	maxBackoff := drain.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultMaxBackoff
+	}
+
+	var spool *spool
+	if drain.Spool != nil {
+		spool, err = openSpool(*drain.Spool, drain)
+		if err != nil {
+			return nil, err
+		}
+
+		d.spool = spool
+	}
+
+	connections := drain.Connections
+	if connections <= 0 {
+		connections = 1
+	}
+
+	for i := 0; i < connections; i++ {
+		w := &worker{
+			destination:      drain.String(),
+			onFailure:        onFailure,
+			endpoints:        endpoints,
+			failoverAfter:    failoverAfter,
+			failbackInterval: failbackInterval,
+			probed:           make(chan *conn),
+
+			formatter: formatter,
+			backoff:   backoff{max: maxBackoff},
+
+			spool:   spool,
+			replays: i == 0,
+
+			packets: d.packets,
+			closing: d.closing,
+		}
+
+		d.workers = append(d.workers, w)
+	}
+
+	// connections are made in the background, so that an unreachable
+	// destination does not hold up the caller; lines are queued until then
+	for _, w := range d.workers {
+		workerStarted(w.destination)
+
+		d.stopped.Add(1)
+		go w.run(&d.stopped)
+	}
+
+	return d, nil
+}
+
+// State returns Connected if any of the drainer's connections is up.
+func (d *drainer) State() ConnState {
+	state := Connecting
+
+	for _, w := range d.workers {
+		switch w.State() {
+		case Connected:
+			return Connected
+		case Disconnected:
+			state = Disconnected
+		}
+	}
+
+	return state
 }
 
-func (d *drainer) Drain(line string, tag string) error {
-	d.logger.Packets <- sl.Packet{
-		Severity: sl.SevInfo,
-		Facility: sl.LogUser,
-		Hostname: d.hostname,
-		Tag:      tag,
-		Time:     time.Now(),
-		Message:  line,
+// Drain queues a line to be written, blocking while the queue is full unless
+// the message is aborted.
+func (d *drainer) Drain(message Message) error {
+	logged := message.Time
+	if logged.IsZero() {
+		logged = time.Now()
+	}
+
+	queued := delivery{
+		packet: packet{
+			Packet: sl.Packet{
+				Severity: sl.Priority(message.Severity),
+				Facility: sl.Priority(message.Facility),
+				Hostname: d.hostname,
+				Tag:      message.Tag,
+				Time:     logged,
+				Message:  message.Line,
+			},
+			Path:   message.Path,
+			Fields: message.Fields,
+		},
+		done: message.done,
 	}
 
 	select {
-	case err := <-d.logger.Errors:
-		return err
+	case d.packets <- queued:
+		return nil
 	default:
+	}
+
+	select {
+	case d.packets <- queued:
 		return nil
+	case <-message.Abort:
+		message.done(ErrClosed)
+		return ErrClosed
+	}
+}
+
+func (d *drainer) Close() error {
+	d.closeOnce.Do(func() {
+		close(d.closing)
+		close(d.packets)
+	})
+
+	d.stopped.Wait()
+
+	d.releaseOnce.Do(func() {
+		if d.spool != nil {
+			d.spool.close()
+		}
+	})
+
+	return nil
+}
+
+// connectToFirstAvailable tries each endpoint in order, so that an
+// unreachable destination does not stop its failovers from being used.
+func (w *worker) connectToFirstAvailable() bool {
+	for i, endpoint := range w.endpoints {
+		conn, err := dial(endpoint)
+		if err != nil {
+			log.Printf("could not connect to %s: %s\n", endpoint.drain, err)
+			continue
+		}
+
+		w.switchTo(i, conn)
+
+		return true
+	}
+
+	w.setState(Disconnected)
+
+	return false
+}
+
+func (w *worker) State() ConnState {
+	return ConnState(atomic.LoadInt32(&w.state))
+}
+
+// setState records the state of the connection to the active endpoint.
+func (w *worker) setState(state ConnState) {
+	previous := ConnState(atomic.SwapInt32(&w.state, int32(state)))
+	if previous == state {
+		return
+	}
+
+	destination := w.endpoints[w.active].drain.String()
+	stateChanged(w.destination, previous, state)
+
+	if state == Connected {
+		log.Printf("connected to %s\n", destination)
+		metrics.Connections.WithLabelValues(destination).Inc()
+
+		if w.connected {
+			metrics.Reconnects.WithLabelValues(w.destination).Inc()
+		}
+
+		w.connected = true
+	} else if previous == Connected {
+		metrics.Connections.WithLabelValues(destination).Dec()
+	}
+}
+
+func (w *worker) run(stopped *sync.WaitGroup) {
+	defer stopped.Done()
+	defer workerStopped(w.destination)
+	defer w.disconnect()
+	defer w.stopProbing()
+
+	w.connectToFirstAvailable()
+
+	if w.onFailure != OnFailureSpool {
+		for delivery := range w.packets {
+			if w.formatter.dropped(delivery.packet) {
+				w.lineFailed(delivery, errTooBig)
+				continue
+			}
+
+			if w.onFailure == OnFailureDrop {
+				w.writeOrDrop(delivery)
+			} else {
+				w.write(delivery)
+			}
+		}
+
+		return
+	}
+
+	for {
+		var retry <-chan time.Time
+		if w.replays && w.spool.Depth() > 0 {
+			retry = time.After(time.Until(w.nextReplay))
+		}
+
+		select {
+		case delivery, ok := <-w.packets:
+			if !ok {
+				return
+			}
+
+			if w.formatter.dropped(delivery.packet) {
+				w.lineFailed(delivery, errTooBig)
+				continue
+			}
+
+			w.writeOrSpool(delivery)
+		case <-retry:
+			w.replay()
+		}
+	}
+}
+
+// write sends a packet, reconnecting and retrying until it succeeds.
+func (w *worker) write(delivery delivery) {
+	for {
+		if w.failures > 0 && w.closed() {
+			// don't hold up closing for a destination that is down
+			w.lineFailed(delivery, ErrClosed)
+			return
+		}
+
+		err := w.tryWrite(delivery.packet)
+		if err == nil {
+			w.delivered(delivery)
+			return
+		}
+
+		if w.closed() {
+			w.lineFailed(delivery, ErrClosed)
+			return
+		}
+
+		if w.failures > 0 {
+			// give the endpoint time to recover, unless we just failed over
+			select {
+			case <-time.After(w.backoff.next()):
+			case <-w.closing:
+				w.lineFailed(delivery, ErrClosed)
+				return
+			}
+		}
+	}
+}
+
+func (w *worker) closed() bool {
+	select {
+	case <-w.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// writeOrDrop makes a single attempt to send a packet, dropping it if that
+// fails. While backing off after a failure, packets are dropped without
+// trying.
+func (w *worker) writeOrDrop(delivery delivery) {
+	if w.conn == nil && time.Now().Before(w.nextAttempt) {
+		w.lineFailed(delivery, errBackingOff)
+		return
+	}
+
+	if err := w.tryWrite(delivery.packet); err != nil {
+		w.nextAttempt = time.Now().Add(w.backoff.next())
+		w.lineFailed(delivery, err)
+		return
+	}
+
+	w.delivered(delivery)
+}
+
+// writeOrSpool sends a packet if the destination is reachable and nothing is
+// waiting to be replayed, and spools it otherwise so that order is kept.
+func (w *worker) writeOrSpool(delivery delivery) {
+	if w.spool.Depth() == 0 {
+		if err := w.tryWrite(delivery.packet); err == nil {
+			w.delivered(delivery)
+			return
+		}
+
+		w.nextReplay = time.Now().Add(w.backoff.next())
+	}
+
+	if err := w.spool.Append(delivery.packet); err != nil {
+		w.lineFailed(delivery, err)
+	} else {
+		// the line is safe on disk
+		w.delivered(delivery)
+	}
+
+	w.replay()
+}
+
+// replay sends spooled packets in order until the spool is empty or a write
+// fails, in which case it backs off before trying again.
+func (w *worker) replay() {
+	if !w.replays || time.Now().Before(w.nextReplay) {
+		return
+	}
+
+	for {
+		packet, found, err := w.spool.Peek()
+		if err != nil {
+			log.Printf("skipping unreadable spooled line for %s: %s\n", w.spool.destination, err)
+		} else if !found {
+			return
+		} else if err := w.tryWrite(packet); err != nil {
+			w.nextReplay = time.Now().Add(w.backoff.next())
+			return
+		}
+
+		if err := w.spool.Pop(); err != nil {
+			log.Printf("could not remove replayed line from spool for %s: %s\n", w.spool.destination, err)
+			w.nextReplay = time.Now().Add(w.backoff.next())
+			return
+		}
+	}
+}
+
+func (w *worker) delivered(delivery delivery) {
+	if delivery.done != nil {
+		delivery.done(nil)
+	}
+}
+
+// lineFailed reports that a line will not be delivered.
+func (w *worker) lineFailed(delivery delivery, err error) {
+	metrics.FailedLines.WithLabelValues(delivery.packet.Tag, w.destination).Inc()
+
+	if delivery.done != nil {
+		delivery.done(err)
+	}
+}
+
+// tryWrite makes a single attempt to send a packet, connecting first if
+// needed.
+func (w *worker) tryWrite(packet packet) error {
+	w.failBack()
+
+	if w.conn == nil {
+		conn, err := dial(w.endpoints[w.active])
+		if err != nil {
+			metrics.SendErrors.WithLabelValues(packet.Tag, w.destination).Inc()
+			w.setState(Disconnected)
+			w.failed(err)
+			return err
+		}
+
+		w.conn = conn
+		w.setState(Connected)
+	}
+
+	err := w.conn.writePacket(packet, w.formatter)
+	if err != nil {
+		metrics.SendErrors.WithLabelValues(packet.Tag, w.destination).Inc()
+		w.disconnect()
+
+		w.failed(err)
+		return err
+	}
+
+	metrics.LinesSent.WithLabelValues(packet.Tag, w.destination).Inc()
+
+	w.failures = 0
+	w.backoff.reset()
+
+	return nil
+}
+
+// failed records a failure of the active endpoint, failing over to the next
+// one if it has failed too many times in a row. It returns whether it failed
+// over.
+func (w *worker) failed(err error) bool {
+	if w.failures == 0 {
+		log.Printf("could not write to %s: %s\n", w.endpoints[w.active].drain, err)
+	}
+
+	w.failures++
+	if len(w.endpoints) == 1 || w.failures < w.failoverAfter {
+		return false
+	}
+
+	next := (w.active + 1) % len(w.endpoints)
+	log.Printf("%s failed %d times (last error: %s); failing over to %s\n",
+		w.endpoints[w.active].drain, w.failures, err, w.endpoints[next].drain)
+
+	w.switchTo(next, nil)
+
+	return true
+}
+
+// failBack switches back to the primary endpoint once a probe has connected
+// to it.
+func (w *worker) failBack() {
+	if !w.probing {
+		return
+	}
+
+	select {
+	case conn := <-w.probed:
+		w.probing = false
+
+		log.Printf("%s has recovered; failing back\n", w.endpoints[0].drain)
+		w.switchTo(0, conn)
+	default:
+	}
+}
+
+// probe tries to connect to the primary endpoint every failback interval,
+// until it can or is stopped, and hands the connection over on probed.
+func (w *worker) probe(primary endpoint, stop <-chan struct{}) {
+	for {
+		select {
+		case <-time.After(w.failbackInterval):
+		case <-stop:
+			return
+		}
+
+		conn, err := dial(primary)
+		if err != nil {
+			continue
+		}
+
+		select {
+		case w.probed <- conn:
+			return
+		case <-stop:
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (w *worker) startProbing() {
+	if w.probing {
+		return
+	}
+
+	w.probing = true
+	w.stopProbe = make(chan struct{})
+
+	go w.probe(w.endpoints[0], w.stopProbe)
+}
+
+func (w *worker) stopProbing() {
+	if !w.probing {
+		return
+	}
+
+	close(w.stopProbe)
+	w.probing = false
+}
+
+func (w *worker) disconnect() {
+	if w.conn != nil {
+		w.conn.Close()
+		w.conn = nil
+		w.setState(Disconnected)
+	}
+}
+
+func (w *worker) switchTo(active int, conn *conn) {
+	w.disconnect()
+
+	w.active = active
+	w.failures = 0
+	w.backoff.reset()
+	w.conn = conn
+
+	if active == 0 {
+		w.stopProbing()
+	} else {
+		w.startProbing()
+	}
+
+	if conn != nil {
+		w.setState(Connected)
 	}
 }
@@ -1,24 +1,96 @@
 package syslog
 
+import "sync"
+
 type DrainerFactory interface {
 	NewDrainer() (Drainer, error)
 }
 
+// drainerFactory hands out handles to a single shared Drainer, so that every
+// tailer writes over the same connections rather than opening its own. The
+// shared Drainer is closed once every handle to it has been closed.
 type drainerFactory struct {
-	destination Drain
-	hostname    string
+	destinations []Drain
+	hostname     string
+
+	lock   sync.Mutex
+	shared Drainer
+	users  int
 }
 
-func NewDrainerFactory(destination Drain, hostname string) DrainerFactory {
+func NewDrainerFactory(destinations []Drain, hostname string) DrainerFactory {
 	return &drainerFactory{
-		destination: destination,
-		hostname:    hostname,
+		destinations: destinations,
+		hostname:     hostname,
 	}
 }
 
+// NewDrainer returns a handle to the Drainer for the configured destination,
+// or one that fans out to every destination if there are several.
 func (f *drainerFactory) NewDrainer() (Drainer, error) {
-	return NewDrainer(
-		f.destination,
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.shared == nil {
+		shared, err := f.newDrainer()
+		if err != nil {
+			return nil, err
+		}
+
+		f.shared = shared
+	}
+
+	f.users++
+
+	return &sharedDrainer{Drainer: f.shared, factory: f}, nil
+}
+
+func (f *drainerFactory) newDrainer() (Drainer, error) {
+	if len(f.destinations) == 1 {
+		return NewDrainer(
+			f.destinations[0],
+			f.hostname,
+		)
+	}
+
+	return NewMultiDrainer(
+		f.destinations,
 		f.hostname,
 	)
 }
+
+// release closes the shared Drainer once its last user is done with it.
+func (f *drainerFactory) release() error {
+	f.lock.Lock()
+
+	f.users--
+	if f.users > 0 {
+		f.lock.Unlock()
+		return nil
+	}
+
+	shared := f.shared
+	f.shared = nil
+
+	f.lock.Unlock()
+
+	return shared.Close()
+}
+
+// sharedDrainer is a single user's handle to a shared Drainer.
+type sharedDrainer struct {
+	Drainer
+
+	factory   *drainerFactory
+	closeOnce sync.Once
+}
+
+func (d *sharedDrainer) Close() error {
+	var err error
+
+	d.closeOnce.Do(func() {
+		err = d.factory.release()
+	})
+
+	return err
+}
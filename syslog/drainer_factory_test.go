@@ -0,0 +1,91 @@
+package syslog_test
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/concourse/blackbox/syslog"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DrainerFactory", func() {
+	var (
+		listener    net.Listener
+		received    chan string
+		connections int32
+		factory     syslog.DrainerFactory
+	)
+
+	message := syslog.Message{
+		Line:     "hello",
+		Tag:      "some-tag",
+		Severity: syslog.DefaultSeverity,
+		Facility: syslog.DefaultFacility,
+	}
+
+	BeforeEach(func() {
+		var err error
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+
+		connections = 0
+		received = serveLinesCountingConnections(listener, &connections)
+
+		factory = syslog.NewDrainerFactory([]syslog.Drain{
+			{Transport: "tcp", Address: listener.Addr().String()},
+		}, "some-host")
+	})
+
+	AfterEach(func() {
+		listener.Close()
+	})
+
+	countConnections := func() int32 {
+		return atomic.LoadInt32(&connections)
+	}
+
+	It("shares a single connection between every drainer it makes", func() {
+		first, err := factory.NewDrainer()
+		Expect(err).NotTo(HaveOccurred())
+		defer first.Close()
+
+		second, err := factory.NewDrainer()
+		Expect(err).NotTo(HaveOccurred())
+		defer second.Close()
+
+		Expect(first.Drain(message)).To(Succeed())
+		Expect(second.Drain(message)).To(Succeed())
+
+		Eventually(received).Should(Receive(HaveSuffix("hello")))
+		Eventually(received).Should(Receive(HaveSuffix("hello")))
+
+		Expect(countConnections()).To(Equal(int32(1)))
+	})
+
+	It("keeps the connection open until every drainer is closed", func() {
+		first, err := factory.NewDrainer()
+		Expect(err).NotTo(HaveOccurred())
+
+		second, err := factory.NewDrainer()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(first.Close()).To(Succeed())
+		Expect(first.Close()).To(Succeed())
+
+		Expect(second.Drain(message)).To(Succeed())
+		Eventually(received).Should(Receive(HaveSuffix("hello")))
+
+		Expect(second.Close()).To(Succeed())
+
+		third, err := factory.NewDrainer()
+		Expect(err).NotTo(HaveOccurred())
+		defer third.Close()
+
+		Expect(third.Drain(message)).To(Succeed())
+		Eventually(received).Should(Receive(HaveSuffix("hello")))
+
+		Expect(countConnections()).To(Equal(int32(2)))
+	})
+})
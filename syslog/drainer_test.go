@@ -0,0 +1,842 @@
+package syslog_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/concourse/blackbox/syslog"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+)
+
+var _ = Describe("Drainer", func() {
+	var (
+		listener net.Listener
+		received chan string
+	)
+
+	message := syslog.Message{
+		Line:     "hello",
+		Tag:      "some-tag",
+		Severity: syslog.DefaultSeverity,
+		Facility: syslog.DefaultFacility,
+	}
+
+	BeforeEach(func() {
+		listener = nil
+	})
+
+	AfterEach(func() {
+		if listener != nil {
+			listener.Close()
+		}
+	})
+
+	Context("over tcp", func() {
+		BeforeEach(func() {
+			listener, received = listenTCP("127.0.0.1:0")
+		})
+
+		It("sends lines with their tag and priority", func() {
+			drainer, err := syslog.NewDrainer(syslog.Drain{
+				Transport: "tcp",
+				Address:   listener.Addr().String(),
+			}, "some-host")
+			Expect(err).NotTo(HaveOccurred())
+			defer drainer.Close()
+
+			Expect(drainer.Drain(message)).To(Succeed())
+
+			var line string
+			Eventually(received).Should(Receive(&line))
+			Expect(line).To(HavePrefix("<14>"))
+			Expect(line).To(ContainSubstring("some-host"))
+			Expect(line).To(ContainSubstring("some-tag"))
+			Expect(line).To(HaveSuffix("hello"))
+		})
+	})
+
+	Context("with a message format", func() {
+		var (
+			drain  syslog.Drain
+			fields map[string]string
+			logged time.Time
+		)
+
+		BeforeEach(func() {
+			fields = nil
+			logged = time.Time{}
+
+			listener, received = listenTCP("127.0.0.1:0")
+
+			drain = syslog.Drain{
+				Transport: "tcp",
+				Address:   listener.Addr().String(),
+				Framing:   syslog.FramingNonTransparent,
+			}
+		})
+
+		send := func() string {
+			drainer, err := syslog.NewDrainer(drain, "some-host")
+			Expect(err).NotTo(HaveOccurred())
+			defer drainer.Close()
+
+			fromFile := message
+			fromFile.Path = "/var/log/app.log"
+			fromFile.Fields = fields
+			fromFile.Time = logged
+			Expect(drainer.Drain(fromFile)).To(Succeed())
+
+			var line string
+			Eventually(received).Should(Receive(&line))
+			return line
+		}
+
+		It("sends rfc5424 messages with structured data", func() {
+			drain.Format = syslog.FormatRFC5424
+			drain.StructuredData.Fields = map[string]string{
+				"zone": `a"b]`,
+				"env":  "prod",
+			}
+
+			Expect(send()).To(MatchRegexp(
+				`^<14>1 \d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{6}(Z|[+-]\d\d:\d\d) some-host some-tag - - ` +
+					`\[blackbox@32473 path="/var/log/app\.log" tag="some-tag" env="prod" zone="a\\"b\\]"\] hello$`,
+			))
+		})
+
+		It("sends the configured procid and msgid in rfc5424 messages", func() {
+			drain.Format = syslog.FormatRFC5424
+			drain.ProcID = "web"
+			drain.MsgID = "access"
+
+			Expect(send()).To(ContainSubstring(" some-host some-tag web access [blackbox@32473 "))
+		})
+
+		It("fails for a msgid that is not valid in a header", func() {
+			drain.Format = syslog.FormatRFC5424
+			drain.MsgID = "has spaces"
+
+			_, err := syslog.NewDrainer(drain, "some-host")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("uses the configured structured data id", func() {
+			drain.Format = syslog.FormatRFC5424
+			drain.StructuredData.ID = "logs@12345"
+
+			Expect(send()).To(ContainSubstring(`[logs@12345 path=`))
+		})
+
+		It("sends rfc3164 messages", func() {
+			drain.Format = syslog.FormatRFC3164
+
+			Expect(send()).To(MatchRegexp(`^<14>[A-Z][a-z]{2} [ \d]\d \d\d:\d\d:\d\d some-host some-tag: hello$`))
+		})
+
+		It("sends fields as structured data in rfc5424 messages", func() {
+			drain.Format = syslog.FormatRFC5424
+			fields = map[string]string{"data.error": "no such host", "source": "app"}
+
+			Expect(send()).To(HaveSuffix(`tag="some-tag" data.error="no such host" source="app"] hello`))
+		})
+
+		It("appends fields to the line in other formats", func() {
+			drain.Format = syslog.FormatRFC3164
+			fields = map[string]string{"data.error": "no such host", "source": "app"}
+
+			Expect(send()).To(HaveSuffix(`some-tag: hello data.error="no such host" source=app`))
+		})
+
+		It("sends lines with the time they were logged", func() {
+			drain.Format = syslog.FormatRFC5424
+			logged = time.Date(2020, 1, 26, 0, 53, 20, 500000000, time.UTC)
+
+			Expect(send()).To(ContainSubstring(" 2020-01-26T00:53:20.500000Z some-host "))
+		})
+
+		It("fails for an unknown format", func() {
+			drain.Format = "rfc1234"
+
+			_, err := syslog.NewDrainer(drain, "some-host")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("fails for an invalid structured data id", func() {
+			drain.Format = syslog.FormatRFC5424
+			drain.StructuredData.ID = "not valid"
+
+			_, err := syslog.NewDrainer(drain, "some-host")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("with a framing", func() {
+		var (
+			stream *gbytes.Buffer
+			drain  syslog.Drain
+		)
+
+		multiline := message
+		multiline.Line = "panic\n\tat main"
+
+		BeforeEach(func() {
+			var err error
+			listener, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+
+			stream = serveBytes(listener)
+
+			drain = syslog.Drain{
+				Transport: "tcp",
+				Address:   listener.Addr().String(),
+			}
+		})
+
+		send := func() string {
+			drainer, err := syslog.NewDrainer(drain, "some-host")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(drainer.Drain(multiline)).To(Succeed())
+			Expect(drainer.Close()).To(Succeed())
+
+			Eventually(stream.Contents).Should(ContainSubstring("at main"))
+			return string(stream.Contents())
+		}
+
+		It("uses octet counting for rfc5424", func() {
+			drain.Format = syslog.FormatRFC5424
+
+			framed := send()
+
+			space := strings.Index(framed, " ")
+			Expect(space).To(BeNumerically(">", 0))
+
+			length, err := strconv.Atoi(framed[:space])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(framed[space+1:]).To(HaveLen(length))
+			Expect(framed[space+1:]).To(HavePrefix("<14>1 "))
+			Expect(framed).To(HaveSuffix(" panic\n\tat main"))
+		})
+
+		It("ends messages with a newline by default for other formats", func() {
+			Expect(send()).To(HaveSuffix("panic\n\tat main\n"))
+		})
+
+		It("ends messages with the configured trailer", func() {
+			drain.Format = syslog.FormatRFC5424
+			drain.Framing = syslog.FramingNonTransparent
+			drain.Trailer = syslog.TrailerNUL
+
+			framed := send()
+			Expect(framed).To(HavePrefix("<14>1 "))
+			Expect(framed).To(HaveSuffix("panic\n\tat main\x00"))
+		})
+
+		It("fails for an unknown framing", func() {
+			drain.Framing = "smoke_signals"
+
+			_, err := syslog.NewDrainer(drain, "some-host")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("fails for a trailer with octet counting", func() {
+			drain.Framing = syslog.FramingOctetCounting
+			drain.Trailer = syslog.TrailerNUL
+
+			_, err := syslog.NewDrainer(drain, "some-host")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("with a maximum message size", func() {
+		var (
+			drain   syslog.Drain
+			drainer syslog.Drainer
+		)
+
+		BeforeEach(func() {
+			listener, received = listenTCP("127.0.0.1:0")
+
+			drain = syslog.Drain{
+				Transport:       "tcp",
+				Address:         listener.Addr().String(),
+				Format:          syslog.FormatRFC3164,
+				MaxMessageBytes: syslog.MinMessageBytes,
+			}
+		})
+
+		JustBeforeEach(func() {
+			var err error
+			drainer, err = syslog.NewDrainer(drain, "some-host")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			drainer.Close()
+		})
+
+		long := func(line string) syslog.Message {
+			longer := message
+			longer.Line = line
+			return longer
+		}
+
+		It("sends messages that fit as they are", func() {
+			drainer.Drain(message)
+			Eventually(received).Should(Receive(HaveSuffix(": hello")))
+		})
+
+		It("truncates oversize lines with a marker, between characters", func() {
+			drainer.Drain(long(strings.Repeat("é", 400)))
+
+			var line string
+			Eventually(received).Should(Receive(&line))
+			Expect(len(line)).To(BeNumerically("<=", syslog.MinMessageBytes))
+			Expect(len(line)).To(BeNumerically(">", syslog.MinMessageBytes-2))
+			Expect(line).To(HaveSuffix("é" + syslog.TruncationMarker))
+			Expect(utf8.ValidString(line)).To(BeTrue())
+		})
+
+		Context("with the split policy", func() {
+			BeforeEach(func() {
+				drain.Oversize = syslog.OversizeSplit
+			})
+
+			It("sends oversize lines as numbered parts", func() {
+				line := strings.Repeat("é", 250) + strings.Repeat("x", 500)
+				drainer.Drain(long(line))
+
+				var parts []string
+				for i := 1; i <= 3; i++ {
+					var part string
+					Eventually(received).Should(Receive(&part))
+					Expect(len(part)).To(BeNumerically("<=", syslog.MinMessageBytes))
+					Expect(utf8.ValidString(part)).To(BeTrue())
+
+					prefix := fmt.Sprintf("some-tag: [%d/3] ", i)
+					Expect(part).To(ContainSubstring(prefix))
+					parts = append(parts, part[strings.Index(part, prefix)+len(prefix):])
+				}
+
+				Expect(strings.Join(parts, "")).To(Equal(line))
+			})
+		})
+
+		Context("with the drop policy", func() {
+			BeforeEach(func() {
+				drain.Oversize = syslog.OversizeDrop
+			})
+
+			It("fails oversize lines without sending them", func() {
+				results := make(chan error, 1)
+				oversize := long(strings.Repeat("x", 500))
+				oversize.Done = func(err error) {
+					results <- err
+				}
+
+				drainer.Drain(oversize)
+				drainer.Drain(message)
+
+				Eventually(results).Should(Receive(HaveOccurred()))
+				Eventually(received).Should(Receive(HaveSuffix(": hello")))
+			})
+		})
+	})
+
+	It("fails for a maximum message size that is too small", func() {
+		_, err := syslog.NewDrainer(syslog.Drain{
+			Transport:       "udp",
+			Address:         "127.0.0.1:1234",
+			MaxMessageBytes: 100,
+		}, "some-host")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("fails for an oversize policy without a maximum message size", func() {
+		_, err := syslog.NewDrainer(syslog.Drain{
+			Transport: "udp",
+			Address:   "127.0.0.1:1234",
+			Oversize:  syslog.OversizeSplit,
+		}, "some-host")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("fails for an unknown oversize policy", func() {
+		_, err := syslog.NewDrainer(syslog.Drain{
+			Transport:       "udp",
+			Address:         "127.0.0.1:1234",
+			MaxMessageBytes: 8192,
+			Oversize:        "shrink",
+		}, "some-host")
+		Expect(err).To(HaveOccurred())
+	})
+
+	Context("over tls", func() {
+		var (
+			certDir string
+			drain   syslog.Drain
+		)
+
+		BeforeEach(func() {
+			var err error
+			certDir, err = ioutil.TempDir("", "syslog-tls")
+			Expect(err).NotTo(HaveOccurred())
+
+			ca, caKey := generateCert(certDir, "ca", nil, nil)
+			server, serverKey := generateCert(certDir, "server", ca, caKey)
+			generateCert(certDir, "client", ca, caKey)
+
+			caPool := x509.NewCertPool()
+			caPool.AddCert(ca)
+
+			listener, err = tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+				Certificates: []tls.Certificate{{
+					Certificate: [][]byte{server.Raw},
+					PrivateKey:  serverKey,
+				}},
+				ClientCAs:  caPool,
+				ClientAuth: tls.RequireAndVerifyClientCert,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			received = serveLines(listener)
+
+			drain = syslog.Drain{
+				Transport: "tls",
+				Address:   listener.Addr().String(),
+				TLS: syslog.TLSConfig{
+					CAFile:     filepath.Join(certDir, "ca.crt"),
+					CertFile:   filepath.Join(certDir, "client.crt"),
+					KeyFile:    filepath.Join(certDir, "client.key"),
+					ServerName: "syslog.example.com",
+				},
+			}
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(certDir)
+		})
+
+		It("sends lines using the client certificate", func() {
+			drainer, err := syslog.NewDrainer(drain, "some-host")
+			Expect(err).NotTo(HaveOccurred())
+			defer drainer.Close()
+
+			Expect(drainer.Drain(message)).To(Succeed())
+
+			var line string
+			Eventually(received).Should(Receive(&line))
+			Expect(line).To(HaveSuffix("hello"))
+		})
+
+		It("fails for an unknown minimum TLS version", func() {
+			drain.TLS.MinVersion = "0.9"
+
+			_, err := syslog.NewDrainer(drain, "some-host")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("fails when the client key is missing", func() {
+			drain.TLS.KeyFile = ""
+
+			_, err := syslog.NewDrainer(drain, "some-host")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	It("reports each line once it has been written", func() {
+		var received chan string
+		listener, received = listenTCP("127.0.0.1:0")
+
+		drainer, err := syslog.NewDrainer(syslog.Drain{
+			Transport: "tcp",
+			Address:   listener.Addr().String(),
+		}, "some-host")
+		Expect(err).NotTo(HaveOccurred())
+		defer drainer.Close()
+
+		results := make(chan error, 1)
+
+		delivered := message
+		delivered.Done = func(err error) { results <- err }
+
+		Expect(drainer.Drain(delivered)).To(Succeed())
+		Eventually(received).Should(Receive(HaveSuffix("hello")))
+		Eventually(results).Should(Receive(BeNil()))
+	})
+
+	It("drops lines that cannot be written with the drop policy", func() {
+		drainer, err := syslog.NewDrainer(syslog.Drain{
+			Transport: "tcp",
+			Address:   unusedAddress(),
+			OnFailure: syslog.OnFailureDrop,
+		}, "some-host")
+		Expect(err).NotTo(HaveOccurred())
+
+		results := make(chan error, 2)
+
+		dropped := message
+		dropped.Done = func(err error) { results <- err }
+
+		Expect(drainer.Drain(dropped)).To(Succeed())
+		Expect(drainer.Drain(dropped)).To(Succeed())
+
+		Eventually(results).Should(Receive(HaveOccurred()))
+		Eventually(results).Should(Receive(HaveOccurred()))
+
+		Expect(drainer.Close()).To(Succeed())
+	})
+
+	It("fails lines that are still queued for an unreachable destination when closed", func() {
+		drainer, err := syslog.NewDrainer(syslog.Drain{
+			Transport: "tcp",
+			Address:   unusedAddress(),
+		}, "some-host")
+		Expect(err).NotTo(HaveOccurred())
+
+		results := make(chan error, 1)
+
+		queued := message
+		queued.Done = func(err error) { results <- err }
+
+		Expect(drainer.Drain(queued)).To(Succeed())
+		Expect(drainer.Close()).To(Succeed())
+
+		Expect(results).To(Receive(Equal(syslog.ErrClosed)))
+	})
+
+	It("still queues an aborted line if there is room for it", func() {
+		listener, received = listenTCP("127.0.0.1:0")
+
+		drainer, err := syslog.NewDrainer(syslog.Drain{
+			Transport: "tcp",
+			Address:   listener.Addr().String(),
+		}, "some-host")
+		Expect(err).NotTo(HaveOccurred())
+		defer drainer.Close()
+
+		abort := make(chan struct{})
+		close(abort)
+
+		aborted := message
+		aborted.Abort = abort
+
+		for i := 0; i < 10; i++ {
+			Expect(drainer.Drain(aborted)).To(Succeed())
+			Eventually(received).Should(Receive(HaveSuffix("hello")))
+		}
+	})
+
+	It("gives up on queueing an aborted line while the queue is full", func() {
+		drainer, err := syslog.NewDrainer(syslog.Drain{
+			Transport: "tcp",
+			Address:   unusedAddress(),
+		}, "some-host")
+		Expect(err).NotTo(HaveOccurred())
+		defer drainer.Close()
+
+		// one line being retried, and a full queue behind it
+		for i := 0; i < 1001; i++ {
+			Expect(drainer.Drain(message)).To(Succeed())
+		}
+
+		results := make(chan error, 1)
+		abort := make(chan struct{})
+
+		aborted := message
+		aborted.Abort = abort
+		aborted.Done = func(err error) { results <- err }
+
+		drained := make(chan error, 1)
+		go func() {
+			drained <- drainer.Drain(aborted)
+		}()
+
+		Consistently(drained).ShouldNot(Receive())
+
+		close(abort)
+		Eventually(drained).Should(Receive(Equal(syslog.ErrClosed)))
+		Expect(results).To(Receive(Equal(syslog.ErrClosed)))
+	})
+
+	It("fails for a spool policy without a spool", func() {
+		_, err := syslog.NewDrainer(syslog.Drain{
+			Transport: "tcp",
+			Address:   "127.0.0.1:1234",
+			OnFailure: syslog.OnFailureSpool,
+		}, "some-host")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("fails for an unknown failure policy", func() {
+		_, err := syslog.NewDrainer(syslog.Drain{
+			Transport: "tcp",
+			Address:   "127.0.0.1:1234",
+			OnFailure: "shrug",
+		}, "some-host")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("does not wait for the destination to be reachable", func() {
+		address := unusedAddress()
+
+		drainer, err := syslog.NewDrainer(syslog.Drain{
+			Transport:  "tcp",
+			Address:    address,
+			MaxBackoff: 200 * time.Millisecond,
+		}, "some-host")
+		Expect(err).NotTo(HaveOccurred())
+		defer drainer.Close()
+
+		drainer.Drain(message)
+		Eventually(drainer.State).Should(Equal(syslog.Disconnected))
+
+		var received chan string
+		listener, received = listenTCP(address)
+
+		Eventually(received).Should(Receive(HaveSuffix("hello")))
+		Expect(drainer.State()).To(Equal(syslog.Connected))
+	})
+
+	It("reports the status of its destination until it is closed", func() {
+		address := unusedAddress()
+
+		drainer, err := syslog.NewDrainer(syslog.Drain{
+			Transport:  "tcp",
+			Address:    address,
+			MaxBackoff: 200 * time.Millisecond,
+		}, "some-host")
+		Expect(err).NotTo(HaveOccurred())
+
+		status := func() syslog.DestinationStatus {
+			for _, status := range syslog.Statuses() {
+				if status.Destination == "tcp://"+address {
+					return status
+				}
+			}
+			return syslog.DestinationStatus{}
+		}
+
+		state := func() syslog.ConnState {
+			return status().State
+		}
+
+		Eventually(state).Should(Equal(syslog.Disconnected))
+		downSince := status().Since
+
+		var received chan string
+		listener, received = listenTCP(address)
+
+		drainer.Drain(message)
+		Eventually(received).Should(Receive())
+
+		Expect(state()).To(Equal(syslog.Connected))
+		Expect(status().Since).To(BeTemporally(">", downSince))
+
+		Expect(drainer.Close()).To(Succeed())
+		Expect(status().Destination).To(BeEmpty())
+	})
+
+	It("writes over as many connections as configured", func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+
+		defer listener.Close()
+
+		var connections int32
+		received := serveLinesCountingConnections(listener, &connections)
+
+		drainer, err := syslog.NewDrainer(syslog.Drain{
+			Transport:   "tcp",
+			Address:     listener.Addr().String(),
+			Connections: 3,
+		}, "some-host")
+		Expect(err).NotTo(HaveOccurred())
+
+		for i := 0; i < 100; i++ {
+			Expect(drainer.Drain(message)).To(Succeed())
+		}
+
+		for i := 0; i < 100; i++ {
+			Eventually(received).Should(Receive(HaveSuffix("hello")))
+		}
+
+		Expect(drainer.Close()).To(Succeed())
+		Expect(atomic.LoadInt32(&connections)).To(Equal(int32(3)))
+	})
+
+	It("fails for an unknown transport", func() {
+		_, err := syslog.NewDrainer(syslog.Drain{
+			Transport: "carrier-pigeon",
+			Address:   "127.0.0.1:1234",
+		}, "some-host")
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+// generateCert writes a certificate and key for name to dir, signed by the
+// given CA or self-signed if there is none.
+func generateCert(dir string, name string, ca *x509.Certificate, caKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"syslog.example.com"},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	parent, parentKey := template, key
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		parent, parentKey = ca, caKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	Expect(err).NotTo(HaveOccurred())
+
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).NotTo(HaveOccurred())
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	Expect(err).NotTo(HaveOccurred())
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	Expect(ioutil.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0600)).To(Succeed())
+	Expect(ioutil.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600)).To(Succeed())
+
+	return cert, key
+}
+
+var _ = Describe("Drainer with failover", func() {
+	var listeners []net.Listener
+
+	listen := func(address string) chan string {
+		listener, received := listenTCP(address)
+		listeners = append(listeners, listener)
+		return received
+	}
+
+	message := syslog.Message{
+		Line:     "hello",
+		Tag:      "some-tag",
+		Severity: syslog.DefaultSeverity,
+		Facility: syslog.DefaultFacility,
+	}
+
+	BeforeEach(func() {
+		listeners = nil
+	})
+
+	AfterEach(func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	})
+
+	It("uses the secondary while the primary is unreachable and fails back once it recovers", func() {
+		primary := unusedAddress()
+		secondary := unusedAddress()
+		secondaryReceived := listen(secondary)
+
+		drainer, err := syslog.NewDrainer(syslog.Drain{
+			Transport: "tcp",
+			Address:   primary,
+			Failover: []syslog.Drain{
+				{Transport: "tcp", Address: secondary},
+			},
+			FailbackInterval: 100 * time.Millisecond,
+		}, "some-host")
+		Expect(err).NotTo(HaveOccurred())
+		defer drainer.Close()
+
+		drainer.Drain(message)
+		Eventually(secondaryReceived).Should(Receive(HaveSuffix("hello")))
+
+		primaryReceived := listen(primary)
+		time.Sleep(200 * time.Millisecond)
+
+		drainer.Drain(message)
+		Eventually(primaryReceived).Should(Receive(HaveSuffix("hello")))
+		Consistently(secondaryReceived).ShouldNot(Receive())
+	})
+
+	It("keeps writing to the secondary while probing a primary that does not respond", func() {
+		primary := unusedAddress()
+		secondary := unusedAddress()
+		secondaryReceived := listen(secondary)
+
+		drainer, err := syslog.NewDrainer(syslog.Drain{
+			Transport: "tls",
+			Address:   primary,
+			Failover: []syslog.Drain{
+				{Transport: "tcp", Address: secondary},
+			},
+			FailoverAfter:    1,
+			FailbackInterval: 100 * time.Millisecond,
+		}, "some-host")
+		Expect(err).NotTo(HaveOccurred())
+		defer drainer.Close()
+
+		drainer.Drain(message)
+		Eventually(secondaryReceived).Should(Receive(HaveSuffix("hello")))
+
+		// accepts connections, but never completes a handshake
+		silent, err := net.Listen("tcp", primary)
+		Expect(err).NotTo(HaveOccurred())
+		listeners = append(listeners, silent)
+
+		accepted := make(chan net.Conn, 10)
+		defer func() {
+			for len(accepted) > 0 {
+				(<-accepted).Close()
+			}
+		}()
+
+		go func() {
+			for {
+				conn, err := silent.Accept()
+				if err != nil {
+					return
+				}
+				accepted <- conn
+			}
+		}()
+
+		for i := 0; i < 5; i++ {
+			time.Sleep(100 * time.Millisecond)
+
+			drainer.Drain(message)
+			Eventually(secondaryReceived, "1s").Should(Receive(HaveSuffix("hello")))
+		}
+
+		Eventually(accepted).ShouldNot(BeEmpty())
+	})
+})
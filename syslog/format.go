@@ -0,0 +1,487 @@
+package syslog
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	sl "github.com/papertrail/remote_syslog2/syslog"
+)
+
+const (
+	FormatRFC5424 = "rfc5424"
+	FormatRFC3164 = "rfc3164"
+)
+
+// Framings, described in RFC 6587, delimit messages sent over tcp and tls.
+// With octet counting, each message is preceded by its length, so messages
+// may contain newlines. With non-transparent framing, each message is
+// followed by a trailer.
+const (
+	FramingOctetCounting  = "octet_counting"
+	FramingNonTransparent = "non_transparent"
+)
+
+// Trailers that end messages sent with non-transparent framing.
+const (
+	TrailerLF   = "lf"
+	TrailerCRLF = "crlf"
+	TrailerNUL  = "nul"
+)
+
+// Policies for lines that make messages bigger than a destination's
+// MaxMessageBytes. Truncated messages end with TruncationMarker; split lines
+// are sent as several messages, each starting with its part number, such as
+// "[2/3] ".
+const (
+	OversizeTruncate = "truncate"
+	OversizeSplit    = "split"
+	OversizeDrop     = "drop"
+)
+
+const TruncationMarker = "[truncated]"
+
+// MinMessageBytes is the smallest MaxMessageBytes allowed; RFC 5424 requires
+// every receiver to accept messages of this size.
+const MinMessageBytes = 480
+
+var trailers = map[string]string{
+	TrailerLF:   "\n",
+	TrailerCRLF: "\r\n",
+	TrailerNUL:  "\x00",
+}
+
+// DefaultStructuredDataID is the SD-ID of the structured data element sent
+// with rfc5424 messages. 32473 is the enterprise number reserved for
+// documentation; set an ID under your own enterprise number to avoid clashes.
+const DefaultStructuredDataID = "blackbox@32473"
+
+const (
+	rfc5424TimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+	rfc5424MaxHostname = 255
+	rfc5424MaxAppName  = 48
+	rfc5424MaxProcID   = 128
+	rfc5424MaxMsgID    = 32
+	rfc5424MaxSDName   = 32
+)
+
+// StructuredData configures the structured data element of rfc5424
+// messages, which always carries the path of the file a line was read from
+// and its tag.
+type StructuredData struct {
+	// ID is the element's SD-ID, DefaultStructuredDataID if empty.
+	ID string `yaml:"id,omitempty"`
+
+	// Fields are static parameters added to every message.
+	Fields map[string]string `yaml:"fields,omitempty"`
+}
+
+// packet is a line waiting to be written, along with everything needed to
+// format it. It is spooled as JSON, so fields may only be added to it.
+type packet struct {
+	sl.Packet
+
+	// Path is the file the line was read from.
+	Path string `json:",omitempty"`
+
+	Fields map[string]string `json:",omitempty"`
+}
+
+type sdParam struct {
+	name  string
+	value string
+}
+
+// formatter renders packets in a destination's configured format and
+// framing.
+type formatter struct {
+	format   string
+	procID   string
+	msgID    string
+	sdID     string
+	sdFields []sdParam
+
+	octetCounting bool
+	trailer       string
+
+	// maxSize is the most bytes a message may have, or 0 if there is no
+	// limit.
+	maxSize  int
+	oversize string
+}
+
+func newFormatter(drain Drain) (formatter, error) {
+	f := formatter{format: drain.Format}
+
+	switch drain.Format {
+	case "", FormatRFC3164, FormatRFC5424:
+	default:
+		return f, fmt.Errorf("unknown syslog format: %s", drain.Format)
+	}
+
+	framing := drain.Framing
+	if framing == "" {
+		framing = FramingNonTransparent
+		if drain.Format == FormatRFC5424 {
+			framing = FramingOctetCounting
+		}
+	}
+
+	switch framing {
+	case FramingOctetCounting:
+		if drain.Trailer != "" {
+			return f, fmt.Errorf("trailer is only used with %s framing", FramingNonTransparent)
+		}
+
+		f.octetCounting = true
+	case FramingNonTransparent:
+		name := drain.Trailer
+		if name == "" {
+			name = TrailerLF
+		}
+
+		trailer, found := trailers[name]
+		if !found {
+			return f, fmt.Errorf("unknown trailer: %s", drain.Trailer)
+		}
+
+		f.trailer = trailer
+	default:
+		return f, fmt.Errorf("unknown framing: %s", drain.Framing)
+	}
+
+	if drain.MaxMessageBytes != 0 && drain.MaxMessageBytes < MinMessageBytes {
+		return f, fmt.Errorf("max_message_bytes must be at least %d", MinMessageBytes)
+	}
+
+	f.maxSize = drain.MaxMessageBytes
+	if drain.Transport != "udp" && (f.maxSize == 0 || f.maxSize > tcpMaxLineLength) {
+		f.maxSize = tcpMaxLineLength
+	}
+
+	switch drain.Oversize {
+	case "":
+		f.oversize = OversizeTruncate
+	case OversizeTruncate, OversizeSplit, OversizeDrop:
+		if drain.MaxMessageBytes == 0 {
+			return f, fmt.Errorf("oversize policy %s needs max_message_bytes", drain.Oversize)
+		}
+
+		f.oversize = drain.Oversize
+	default:
+		return f, fmt.Errorf("unknown oversize policy: %s", drain.Oversize)
+	}
+
+	if drain.Format != FormatRFC5424 {
+		return f, nil
+	}
+
+	if !validHeaderField(drain.ProcID, rfc5424MaxProcID) {
+		return f, fmt.Errorf("invalid procid: %q", drain.ProcID)
+	}
+
+	if !validHeaderField(drain.MsgID, rfc5424MaxMsgID) {
+		return f, fmt.Errorf("invalid msgid: %q", drain.MsgID)
+	}
+
+	f.procID = headerField(drain.ProcID, rfc5424MaxProcID)
+	f.msgID = headerField(drain.MsgID, rfc5424MaxMsgID)
+
+	f.sdID = drain.StructuredData.ID
+	if f.sdID == "" {
+		f.sdID = DefaultStructuredDataID
+	}
+
+	if !validSDName(f.sdID) {
+		return f, fmt.Errorf("invalid structured data id: %q", f.sdID)
+	}
+
+	for name, value := range drain.StructuredData.Fields {
+		if !validSDName(name) {
+			return f, fmt.Errorf("invalid structured data field name: %q", name)
+		}
+
+		f.sdFields = append(f.sdFields, sdParam{name: name, value: value})
+	}
+
+	sort.Slice(f.sdFields, func(i, j int) bool {
+		return f.sdFields[i].name < f.sdFields[j].name
+	})
+
+	return f, nil
+}
+
+// generate renders a packet without any limit on its size.
+func (f formatter) generate(p packet) string {
+	return f.render(p, f.line(p))
+}
+
+// line is what is sent as a packet's message: its line, followed by its
+// fields unless they are sent as structured data.
+func (f formatter) line(p packet) string {
+	if f.format == FormatRFC5424 || len(p.Fields) == 0 {
+		return p.Message
+	}
+
+	names := make([]string, 0, len(p.Fields))
+	for name := range p.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	line := &strings.Builder{}
+	line.WriteString(p.Message)
+	for _, name := range names {
+		fmt.Fprintf(line, " %s=%s", name, suffixValue(p.Fields[name]))
+	}
+
+	return line.String()
+}
+
+// render renders a packet with the given line as its message.
+func (f formatter) render(p packet, line string) string {
+	p.Message = line
+
+	switch f.format {
+	case FormatRFC5424:
+		return f.rfc5424(p)
+	case FormatRFC3164:
+		return rfc3164(p)
+	default:
+		return p.Generate(0)
+	}
+}
+
+// dropped reports whether a packet is too big to send, and is to be dropped
+// rather than truncated or split.
+func (f formatter) dropped(p packet) bool {
+	return f.oversize == OversizeDrop && f.maxSize > 0 && len(f.generate(p)) > f.maxSize
+}
+
+// messages renders a packet as the messages to send for it. There is only
+// one unless its line had to be split to keep each message within maxSize.
+func (f formatter) messages(p packet) []string {
+	line := f.line(p)
+
+	msg := f.render(p, line)
+	if f.maxSize == 0 || len(msg) <= f.maxSize {
+		return []string{msg}
+	}
+
+	// the line comes last in every format, so everything before it is the
+	// same for each part of it
+	header := f.render(p, "")
+
+	room := f.maxSize - len(header)
+
+	if f.oversize == OversizeSplit {
+		// if it cannot be split, it is truncated instead
+		if parts := splitLine(line, room); parts != nil {
+			msgs := make([]string, len(parts))
+			for i, part := range parts {
+				msgs[i] = header + part
+			}
+
+			return msgs
+		}
+	}
+
+	if room < len(TruncationMarker) {
+		// a very long tag or path leaves no room for the line at all
+		return []string{cutUTF8(msg, f.maxSize)}
+	}
+
+	return []string{header + cutUTF8(line, room-len(TruncationMarker)) + TruncationMarker}
+}
+
+// splitLine splits a line into numbered parts of at most room bytes each,
+// or returns nil if there is too little room to.
+func splitLine(line string, room int) []string {
+	// the numbers take up more room the more parts there are, so find how
+	// many digits they need
+	for digits := 1; ; digits++ {
+		// "[n/n] "
+		available := room - (2*digits + 4)
+		if available < utf8.UTFMax {
+			return nil
+		}
+
+		var chunks []string
+		for rest := line; rest != ""; {
+			chunk := cutUTF8(rest, available)
+			chunks = append(chunks, chunk)
+			rest = rest[len(chunk):]
+		}
+
+		if len(fmt.Sprint(len(chunks))) > digits {
+			continue
+		}
+
+		parts := make([]string, len(chunks))
+		for i, chunk := range chunks {
+			parts[i] = fmt.Sprintf("[%d/%d] %s", i+1, len(chunks), chunk)
+		}
+
+		return parts
+	}
+}
+
+// cutUTF8 returns the longest prefix of s that is at most n bytes long and
+// does not end partway through a character.
+func cutUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+
+	return s[:n]
+}
+
+// frame delimits a message for sending over a stream transport.
+func (f formatter) frame(msg string) string {
+	if f.octetCounting {
+		return fmt.Sprintf("%d %s", len(msg), msg)
+	}
+
+	return msg + f.trailer
+}
+
+// rfc5424 renders a packet as described in RFC 5424, section 6.
+func (f formatter) rfc5424(p packet) string {
+	params := append([]sdParam{
+		{name: "path", value: p.Path},
+		{name: "tag", value: p.Tag},
+	}, f.sdFields...)
+
+	var fields []sdParam
+	for name, value := range p.Fields {
+		fields = append(fields, sdParam{name: sdName(name), value: value})
+	}
+
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].name < fields[j].name
+	})
+
+	params = append(params, fields...)
+
+	sd := &strings.Builder{}
+	sd.WriteString("[" + f.sdID)
+	for _, param := range params {
+		fmt.Fprintf(sd, ` %s="%s"`, param.name, escapeSDValue(param.value))
+	}
+	sd.WriteString("]")
+
+	return fmt.Sprintf(
+		"<%d>1 %s %s %s %s %s %s %s",
+		p.Priority(),
+		p.Time.Format(rfc5424TimeFormat),
+		headerField(p.Hostname, rfc5424MaxHostname),
+		headerField(p.Tag, rfc5424MaxAppName),
+		f.procID,
+		f.msgID,
+		sd,
+		p.Message,
+	)
+}
+
+// rfc3164 renders a packet in the BSD syslog format described in RFC 3164,
+// for receivers that do not understand anything newer.
+func rfc3164(p packet) string {
+	hostname := p.Hostname
+	if hostname == "" {
+		hostname = "-"
+	}
+
+	return fmt.Sprintf(
+		"<%d>%s %s %s: %s",
+		p.Priority(),
+		p.Time.Format(time.Stamp),
+		hostname,
+		p.Tag,
+		p.Message,
+	)
+}
+
+// headerField makes a value fit for an rfc5424 header field, which may only
+// contain printable ASCII and is "-" when empty.
+func headerField(value string, maxLength int) string {
+	field := strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return '_'
+		}
+		return r
+	}, value)
+
+	if len(field) > maxLength {
+		field = field[:maxLength]
+	}
+
+	if field == "" {
+		return "-"
+	}
+
+	return field
+}
+
+// validHeaderField reports whether a configured value can be sent as an
+// rfc5424 header field as it is. Empty values are sent as "-".
+func validHeaderField(value string, maxLength int) bool {
+	return value == "" || value == headerField(value, maxLength)
+}
+
+func validSDName(name string) bool {
+	if name == "" || len(name) > rfc5424MaxSDName {
+		return false
+	}
+
+	for _, r := range name {
+		if r < 33 || r > 126 || r == '=' || r == ']' || r == '"' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sdName makes a field's name fit for an SD-PARAM name.
+func sdName(name string) string {
+	sanitized := strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 || r == '=' || r == ']' || r == '"' {
+			return '_'
+		}
+		return r
+	}, name)
+
+	if len(sanitized) > rfc5424MaxSDName {
+		sanitized = sanitized[:rfc5424MaxSDName]
+	}
+
+	if sanitized == "" {
+		return "_"
+	}
+
+	return sanitized
+}
+
+// suffixValue quotes a field's value when appending it to a line, if it
+// would otherwise be ambiguous.
+func suffixValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+		return strconv.Quote(value)
+	}
+
+	return value
+}
+
+var sdValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+func escapeSDValue(value string) string {
+	return sdValueEscaper.Replace(value)
+}
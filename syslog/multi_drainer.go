@@ -0,0 +1,171 @@
+package syslog
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/concourse/blackbox/metrics"
+)
+
+const destinationQueueSize = 1000
+
+// multiDrainer delivers every message to each of several destinations. Each
+// destination is connected to and written to from its own goroutine, so a
+// slow or unreachable destination only delays its own messages.
+type multiDrainer struct {
+	destinations []*destination
+	closeOnce    sync.Once
+}
+
+type destination struct {
+	drain     Drain
+	onFailure string
+	messages  chan Message
+	stopped   chan struct{}
+}
+
+func NewMultiDrainer(drains []Drain, hostname string) (*multiDrainer, error) {
+	d := &multiDrainer{}
+
+	for _, drain := range drains {
+		if err := drain.validate(); err != nil {
+			return nil, fmt.Errorf("invalid destination %s: %s", drain, err)
+		}
+
+		// validated above
+		onFailure, _ := drain.onFailure()
+
+		d.destinations = append(d.destinations, &destination{
+			drain:     drain,
+			onFailure: onFailure,
+			messages:  make(chan Message, destinationQueueSize),
+			stopped:   make(chan struct{}),
+		})
+	}
+
+	for _, dest := range d.destinations {
+		go dest.run(hostname)
+	}
+
+	return d, nil
+}
+
+// Drain queues the message for every destination. If a destination has
+// fallen too far behind, the message is dropped for that destination alone
+// if its failure policy is to drop lines. Otherwise Drain waits for room in
+// its queue, so that the line is retried or spooled like any other, giving up
+// if the message is aborted. The message's Done is called once every
+// destination has delivered it or failed to, with an error if any of them
+// failed.
+func (d *multiDrainer) Drain(message Message) error {
+	results := &multiResult{
+		remaining: len(d.destinations),
+		done:      message.Done,
+	}
+
+	message.Done = results.settle
+
+	var dropped []string
+	aborted := false
+
+	for _, dest := range d.destinations {
+		select {
+		case dest.messages <- message:
+			continue
+		default:
+		}
+
+		if dest.onFailure == OnFailureDrop {
+			dropped = append(dropped, dest.drain.String())
+
+			metrics.FailedLines.WithLabelValues(message.Tag, dest.drain.String()).Inc()
+			results.settle(fmt.Errorf("queue full for %s", dest.drain))
+			continue
+		}
+
+		select {
+		case dest.messages <- message:
+		case <-message.Abort:
+			aborted = true
+			results.settle(ErrClosed)
+		}
+	}
+
+	if aborted {
+		return ErrClosed
+	}
+
+	if len(dropped) > 0 {
+		return fmt.Errorf("queue full; dropped line for %s", strings.Join(dropped, ", "))
+	}
+
+	return nil
+}
+
+// Close closes every destination once the lines queued for it have been
+// sent.
+func (d *multiDrainer) Close() error {
+	d.closeOnce.Do(func() {
+		for _, dest := range d.destinations {
+			close(dest.messages)
+		}
+	})
+
+	for _, dest := range d.destinations {
+		<-dest.stopped
+	}
+
+	return nil
+}
+
+func (dest *destination) run(hostname string) {
+	defer close(dest.stopped)
+
+	drainer, err := NewDrainer(dest.drain, hostname)
+	if err != nil {
+		log.Printf("could not drain to %s: %s\n", dest.drain, err)
+
+		for message := range dest.messages {
+			metrics.FailedLines.WithLabelValues(message.Tag, dest.drain.String()).Inc()
+			message.done(err)
+		}
+
+		return
+	}
+
+	for message := range dest.messages {
+		drainer.Drain(message)
+	}
+
+	drainer.Close()
+}
+
+// multiResult combines the delivery results of a message from every
+// destination into one.
+type multiResult struct {
+	lock      sync.Mutex
+	remaining int
+	err       error
+	done      func(err error)
+}
+
+func (r *multiResult) settle(err error) {
+	r.lock.Lock()
+
+	// a line that was not sent must be read again after a restart, which
+	// takes precedence over it having failed elsewhere
+	if err != nil && (r.err == nil || err == ErrClosed) {
+		r.err = err
+	}
+
+	r.remaining--
+	finished := r.remaining == 0
+
+	r.lock.Unlock()
+
+	if finished && r.done != nil {
+		r.done(r.err)
+	}
+}
@@ -0,0 +1,134 @@
+package syslog_test
+
+import (
+	"net"
+
+	"github.com/concourse/blackbox/syslog"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MultiDrainer", func() {
+	var listeners []net.Listener
+
+	listen := func() (string, chan string) {
+		listener, received := listenTCP("127.0.0.1:0")
+		listeners = append(listeners, listener)
+		return listener.Addr().String(), received
+	}
+
+	message := syslog.Message{
+		Line:     "hello",
+		Tag:      "some-tag",
+		Severity: syslog.DefaultSeverity,
+		Facility: syslog.DefaultFacility,
+	}
+
+	BeforeEach(func() {
+		listeners = nil
+	})
+
+	AfterEach(func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	})
+
+	It("delivers every line to each destination", func() {
+		first, firstReceived := listen()
+		second, secondReceived := listen()
+
+		drainer, err := syslog.NewMultiDrainer([]syslog.Drain{
+			{Transport: "tcp", Address: first},
+			{Transport: "tcp", Address: second},
+		}, "some-host")
+		Expect(err).NotTo(HaveOccurred())
+		defer drainer.Close()
+
+		Expect(drainer.Drain(message)).To(Succeed())
+
+		Eventually(firstReceived).Should(Receive(HaveSuffix("hello")))
+		Eventually(secondReceived).Should(Receive(HaveSuffix("hello")))
+	})
+
+	It("keeps delivering to the other destinations while one is down", func() {
+		up, received := listen()
+		down := unusedAddress()
+
+		drainer, err := syslog.NewMultiDrainer([]syslog.Drain{
+			{Transport: "tcp", Address: down},
+			{Transport: "tcp", Address: up},
+		}, "some-host")
+		Expect(err).NotTo(HaveOccurred())
+		defer drainer.Close()
+
+		Expect(drainer.Drain(message)).To(Succeed())
+
+		Eventually(received).Should(Receive(HaveSuffix("hello")))
+	})
+
+	It("reports a line's result once every destination has settled it", func() {
+		up, received := listen()
+		down := unusedAddress()
+
+		drainer, err := syslog.NewMultiDrainer([]syslog.Drain{
+			{Transport: "tcp", Address: up},
+			{Transport: "tcp", Address: down, OnFailure: syslog.OnFailureDrop},
+		}, "some-host")
+		Expect(err).NotTo(HaveOccurred())
+		defer drainer.Close()
+
+		results := make(chan error, 2)
+
+		tracked := message
+		tracked.Done = func(err error) { results <- err }
+
+		Expect(drainer.Drain(tracked)).To(Succeed())
+
+		Eventually(received).Should(Receive(HaveSuffix("hello")))
+		Eventually(results).Should(Receive(MatchError(ContainSubstring(down))))
+		Consistently(results).ShouldNot(Receive())
+	})
+
+	It("waits for room in a destination's queue instead of dropping lines it would retry", func() {
+		down := unusedAddress()
+
+		drainer, err := syslog.NewMultiDrainer([]syslog.Drain{
+			{Transport: "tcp", Address: down},
+		}, "some-host")
+		Expect(err).NotTo(HaveOccurred())
+		defer drainer.Close()
+
+		abort := make(chan struct{})
+		errs := make(chan error, 1)
+
+		go func() {
+			defer GinkgoRecover()
+
+			for {
+				aborted := message
+				aborted.Abort = abort
+
+				if err := drainer.Drain(aborted); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+
+		Consistently(errs).ShouldNot(Receive())
+
+		close(abort)
+
+		Eventually(errs).Should(Receive(Equal(syslog.ErrClosed)))
+	})
+
+	It("fails for an invalid destination", func() {
+		_, err := syslog.NewMultiDrainer([]syslog.Drain{
+			{Transport: "tcp", Address: "127.0.0.1:1234"},
+			{Transport: "carrier-pigeon", Address: "127.0.0.1:1234"},
+		}, "some-host")
+		Expect(err).To(HaveOccurred())
+	})
+})
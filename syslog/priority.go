@@ -0,0 +1,147 @@
+package syslog
+
+import (
+	"fmt"
+	"strings"
+
+	sl "github.com/papertrail/remote_syslog2/syslog"
+)
+
+// Severity is a syslog severity that is configured by name, e.g. "err".
+type Severity sl.Priority
+
+// Facility is a syslog facility that is configured by name, e.g. "auth".
+type Facility sl.Priority
+
+const (
+	DefaultSeverity = Severity(sl.SevInfo)
+	DefaultFacility = Facility(sl.LogUser)
+
+	WarningSeverity = Severity(sl.SevWarning)
+)
+
+var severities = map[string]Severity{
+	"emerg":   Severity(sl.SevEmerg),
+	"alert":   Severity(sl.SevAlert),
+	"crit":    Severity(sl.SevCrit),
+	"err":     Severity(sl.SevErr),
+	"warning": Severity(sl.SevWarning),
+	"notice":  Severity(sl.SevNotice),
+	"info":    Severity(sl.SevInfo),
+	"debug":   Severity(sl.SevDebug),
+}
+
+var severityAliases = map[string]string{
+	"emergency": "emerg",
+	"panic":     "emerg",
+	"critical":  "crit",
+	"fatal":     "crit",
+	"error":     "err",
+	"warn":      "warning",
+}
+
+var facilities = map[string]Facility{
+	"kern":     Facility(sl.LogKern),
+	"user":     Facility(sl.LogUser),
+	"mail":     Facility(sl.LogMail),
+	"daemon":   Facility(sl.LogDaemon),
+	"auth":     Facility(sl.LogAuth),
+	"syslog":   Facility(sl.LogSyslog),
+	"lpr":      Facility(sl.LogLPR),
+	"news":     Facility(sl.LogNews),
+	"uucp":     Facility(sl.LogUUCP),
+	"cron":     Facility(sl.LogCron),
+	"authpriv": Facility(sl.LogAuthPriv),
+	"ftp":      Facility(sl.LogFTP),
+	"local0":   Facility(sl.LogLocal0),
+	"local1":   Facility(sl.LogLocal1),
+	"local2":   Facility(sl.LogLocal2),
+	"local3":   Facility(sl.LogLocal3),
+	"local4":   Facility(sl.LogLocal4),
+	"local5":   Facility(sl.LogLocal5),
+	"local6":   Facility(sl.LogLocal6),
+	"local7":   Facility(sl.LogLocal7),
+}
+
+func ParseSeverity(name string) (Severity, error) {
+	name = strings.ToLower(name)
+	if alias, found := severityAliases[name]; found {
+		name = alias
+	}
+
+	severity, found := severities[name]
+	if !found {
+		return 0, fmt.Errorf("unknown syslog severity: %s", name)
+	}
+
+	return severity, nil
+}
+
+func ParseFacility(name string) (Facility, error) {
+	facility, found := facilities[strings.ToLower(name)]
+	if !found {
+		return 0, fmt.Errorf("unknown syslog facility: %s", name)
+	}
+
+	return facility, nil
+}
+
+func (s Severity) String() string {
+	for name, severity := range severities {
+		if severity == s {
+			return name
+		}
+	}
+
+	return fmt.Sprintf("%d", s)
+}
+
+func (f Facility) String() string {
+	for name, facility := range facilities {
+		if facility == f {
+			return name
+		}
+	}
+
+	return fmt.Sprintf("%d", f)
+}
+
+func (s *Severity) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err != nil {
+		return err
+	}
+
+	severity, err := ParseSeverity(name)
+	if err != nil {
+		return err
+	}
+
+	*s = severity
+
+	return nil
+}
+
+func (s Severity) MarshalYAML() (interface{}, error) {
+	return s.String(), nil
+}
+
+func (f *Facility) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err != nil {
+		return err
+	}
+
+	facility, err := ParseFacility(name)
+	if err != nil {
+		return err
+	}
+
+	*f = facility
+
+	return nil
+}
+
+func (f Facility) MarshalYAML() (interface{}, error) {
+	return f.String(), nil
+}
@@ -0,0 +1,345 @@
+package syslog
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/concourse/blackbox/metrics"
+)
+
+const DefaultSpoolMaxBytes = 100 * 1024 * 1024
+
+// SpoolConfig enables spooling lines to disk while a destination cannot be
+// reached, so that they survive until it comes back or blackbox restarts.
+type SpoolConfig struct {
+	Dir      string `yaml:"dir"`
+	MaxBytes int64  `yaml:"max_bytes,omitempty"`
+}
+
+var ErrSpoolFull = errors.New("spool is full")
+
+// spool is an append-only file of packets that are replayed in the order
+// they were written. It is shared by every drainer for a destination.
+//
+// How far it has been replayed is kept in a file next to it, so that lines
+// are not replayed again after a restart. Replayed lines are removed from the
+// spool once everything has been replayed, or once they take up half of
+// maxBytes.
+type spool struct {
+	destination string
+	path        string
+	maxBytes    int64
+
+	// users is the number of drainers using the spool, guarded by
+	// spoolsLock.
+	users int
+
+	lock       sync.Mutex
+	file       *os.File
+	offsetFile *os.File
+	size       int64
+	readOffset int64
+	depth      int
+}
+
+var (
+	spoolsLock sync.Mutex
+	spools     = map[string]*spool{}
+)
+
+// openSpool returns the spool for the destination, opening it and counting
+// any lines left over from a previous run the first time it is needed.
+func openSpool(config SpoolConfig, drain Drain) (*spool, error) {
+	spoolsLock.Lock()
+	defer spoolsLock.Unlock()
+
+	name := strings.NewReplacer(":", "_", "/", "_").Replace(drain.Transport + "_" + drain.Address)
+	path := filepath.Join(config.Dir, name+".spool")
+
+	if s, found := spools[path]; found {
+		s.users++
+		return s, nil
+	}
+
+	if err := os.MkdirAll(config.Dir, 0700); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	offsetFile, err := os.OpenFile(path+".offset", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	s := &spool{
+		destination: drain.String(),
+		path:        path,
+		maxBytes:    config.MaxBytes,
+		users:       1,
+		file:        file,
+		offsetFile:  offsetFile,
+	}
+
+	if s.maxBytes <= 0 {
+		s.maxBytes = DefaultSpoolMaxBytes
+	}
+
+	if err := s.load(); err != nil {
+		file.Close()
+		offsetFile.Close()
+		return nil, err
+	}
+
+	metrics.SpoolDepth.WithLabelValues(s.destination).Set(float64(s.depth))
+
+	spools[path] = s
+
+	return s, nil
+}
+
+// load counts the lines left over from a previous run that have not been
+// replayed yet.
+func (s *spool) load() error {
+	contents, err := ioutil.ReadAll(s.offsetFile)
+	if err != nil {
+		return err
+	}
+
+	// a missing or mangled offset only means lines are replayed again
+	savedOffset, _ := strconv.ParseInt(strings.TrimSpace(string(contents)), 10, 64)
+
+	records := 0
+
+	reader := bufio.NewReader(s.file)
+	for {
+		record, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if s.size < savedOffset {
+			s.readOffset = s.size + int64(len(record))
+		} else {
+			s.depth++
+		}
+
+		s.size += int64(len(record))
+		records++
+	}
+
+	if savedOffset > s.size {
+		// the spool was emptied since the offset was saved, so every line
+		// in it is yet to be replayed
+		s.readOffset = 0
+		s.depth = records
+	}
+
+	// drop a partially written record left behind by a crash
+	return s.file.Truncate(s.size)
+}
+
+// close stops using the spool, closing it once no drainer is using it.
+func (s *spool) close() {
+	spoolsLock.Lock()
+	defer spoolsLock.Unlock()
+
+	s.users--
+	if s.users > 0 {
+		return
+	}
+
+	delete(spools, s.path)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.file.Close()
+	s.offsetFile.Close()
+}
+
+func (s *spool) Depth() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.depth
+}
+
+// Append adds a packet to the end of the spool, dropping it if that would
+// take the spool over its size limit.
+func (s *spool) Append(packet packet) error {
+	record, err := json.Marshal(packet)
+	if err != nil {
+		return err
+	}
+
+	record = append(record, '\n')
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.size-s.readOffset+int64(len(record)) > s.maxBytes {
+		metrics.SpoolDropped.WithLabelValues(s.destination).Inc()
+		return ErrSpoolFull
+	}
+
+	if _, err := s.file.Write(record); err != nil {
+		return err
+	}
+
+	s.size += int64(len(record))
+	s.depth++
+
+	metrics.SpoolDepth.WithLabelValues(s.destination).Set(float64(s.depth))
+
+	return nil
+}
+
+// Peek returns the oldest packet in the spool without removing it.
+func (s *spool) Peek() (packet, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var packet packet
+
+	if s.depth == 0 {
+		return packet, false, nil
+	}
+
+	record, err := s.readRecord()
+	if err != nil {
+		return packet, false, err
+	}
+
+	if err := json.Unmarshal(record, &packet); err != nil {
+		return packet, false, err
+	}
+
+	return packet, true, nil
+}
+
+// Pop removes the oldest packet, once it has been replayed.
+func (s *spool) Pop() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.depth == 0 {
+		return nil
+	}
+
+	record, err := s.readRecord()
+	if err != nil {
+		return err
+	}
+
+	s.readOffset += int64(len(record))
+	s.depth--
+
+	metrics.SpoolDepth.WithLabelValues(s.destination).Set(float64(s.depth))
+
+	if s.depth == 0 {
+		// the offset is reset first, as a stale one would skip the lines
+		// spooled after a crash in between; this way they are replayed
+		// again instead, as when compacting
+		replayed := s.readOffset
+		s.readOffset = 0
+
+		if err := s.saveOffset(); err != nil {
+			s.readOffset = replayed
+			return err
+		}
+
+		if err := s.file.Truncate(0); err != nil {
+			s.readOffset = replayed
+			return err
+		}
+
+		s.size = 0
+
+		return nil
+	}
+
+	if s.readOffset >= s.maxBytes/2 {
+		if err := s.compact(); err != nil {
+			// the replayed lines are only taking up space
+			log.Printf("could not compact spool for %s: %s\n", s.destination, err)
+		}
+	}
+
+	return s.saveOffset()
+}
+
+// compact rewrites the spool without the lines that have been replayed.
+func (s *spool) compact() error {
+	compacted, err := os.OpenFile(s.path+".compacted", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(compacted, io.NewSectionReader(s.file, s.readOffset, s.size-s.readOffset))
+	if err == nil {
+		err = compacted.Sync()
+	}
+
+	compacted.Close()
+
+	if err != nil {
+		return err
+	}
+
+	// crashing in between replays the spool from the start again, which
+	// repeats lines rather than losing them
+	replayed := s.readOffset
+	s.readOffset = 0
+
+	if err := s.saveOffset(); err != nil {
+		s.readOffset = replayed
+		return err
+	}
+
+	if err := os.Rename(s.path+".compacted", s.path); err != nil {
+		s.readOffset = replayed
+		return err
+	}
+
+	file, err := os.OpenFile(s.path, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	s.file.Close()
+	s.file = file
+	s.size -= replayed
+
+	return nil
+}
+
+// saveOffset records how far the spool has been replayed. The offset is
+// written at a fixed width, so that it is never left half overwritten.
+func (s *spool) saveOffset() error {
+	_, err := s.offsetFile.WriteAt([]byte(fmt.Sprintf("%019d\n", s.readOffset)), 0)
+	return err
+}
+
+func (s *spool) readRecord() ([]byte, error) {
+	reader := bufio.NewReader(io.NewSectionReader(s.file, s.readOffset, s.size-s.readOffset))
+	return reader.ReadBytes('\n')
+}
@@ -0,0 +1,257 @@
+package syslog_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/concourse/blackbox/syslog"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Drainer with a spool", func() {
+	var (
+		spoolDir string
+		listener net.Listener
+	)
+
+	BeforeEach(func() {
+		var err error
+		spoolDir, err = ioutil.TempDir("", "syslog-spool")
+		Expect(err).NotTo(HaveOccurred())
+
+		listener = nil
+	})
+
+	AfterEach(func() {
+		if listener != nil {
+			listener.Close()
+		}
+
+		os.RemoveAll(spoolDir)
+	})
+
+	message := func(line string) syslog.Message {
+		return syslog.Message{
+			Line:     line,
+			Tag:      "some-tag",
+			Severity: syslog.DefaultSeverity,
+			Facility: syslog.DefaultFacility,
+		}
+	}
+
+	spoolFile := func() string {
+		files, _ := filepath.Glob(filepath.Join(spoolDir, "*.spool"))
+		if len(files) != 1 {
+			return ""
+		}
+
+		return files[0]
+	}
+
+	spooledLines := func() int {
+		contents, _ := ioutil.ReadFile(spoolFile())
+		return strings.Count(string(contents), "\n")
+	}
+
+	It("spools lines while the destination is down and replays them in order", func() {
+		address := unusedAddress()
+
+		drainer, err := syslog.NewDrainer(syslog.Drain{
+			Transport:  "tcp",
+			Address:    address,
+			Spool:      &syslog.SpoolConfig{Dir: spoolDir},
+			MaxBackoff: time.Second,
+		}, "some-host")
+		Expect(err).NotTo(HaveOccurred())
+		defer drainer.Close()
+
+		drainer.Drain(message("first"))
+		drainer.Drain(message("second"))
+
+		Eventually(spooledLines).Should(Equal(2))
+
+		var received chan string
+		listener, received = listenTCP(address)
+
+		Eventually(received, "5s").Should(Receive(HaveSuffix("first")))
+		Eventually(received).Should(Receive(HaveSuffix("second")))
+
+		drainer.Drain(message("third"))
+		Eventually(received).Should(Receive(HaveSuffix("third")))
+	})
+
+	It("drops lines once the spool is full", func() {
+		drainer, err := syslog.NewDrainer(syslog.Drain{
+			Transport: "tcp",
+			Address:   unusedAddress(),
+			Spool:     &syslog.SpoolConfig{Dir: spoolDir, MaxBytes: 10},
+		}, "some-host")
+		Expect(err).NotTo(HaveOccurred())
+		defer drainer.Close()
+
+		results := make(chan error, 1)
+
+		tooBig := message("too big to fit")
+		tooBig.Done = func(err error) { results <- err }
+
+		Expect(drainer.Drain(tooBig)).To(Succeed())
+		Eventually(results).Should(Receive(Equal(syslog.ErrSpoolFull)))
+	})
+
+	It("replays every line once reopened if its offset is stale", func() {
+		address := unusedAddress()
+
+		drainer, err := syslog.NewDrainer(syslog.Drain{
+			Transport: "tcp",
+			Address:   address,
+			Spool:     &syslog.SpoolConfig{Dir: spoolDir},
+		}, "some-host")
+		Expect(err).NotTo(HaveOccurred())
+
+		drainer.Drain(message("first"))
+		drainer.Drain(message("second"))
+
+		Eventually(spooledLines).Should(Equal(2))
+		Expect(drainer.Close()).To(Succeed())
+
+		// as left behind by a crash after the spool was emptied, but before
+		// its offset was reset
+		err = ioutil.WriteFile(spoolFile()+".offset", []byte("1000"), 0600)
+		Expect(err).NotTo(HaveOccurred())
+
+		var received chan string
+		listener, received = listenTCP(address)
+
+		drainer, err = syslog.NewDrainer(syslog.Drain{
+			Transport: "tcp",
+			Address:   address,
+			Spool:     &syslog.SpoolConfig{Dir: spoolDir},
+		}, "some-host")
+		Expect(err).NotTo(HaveOccurred())
+		defer drainer.Close()
+
+		var line string
+		Eventually(received, "5s").Should(Receive(&line))
+		Expect(line).To(HaveSuffix("first"))
+
+		Eventually(received).Should(Receive(&line))
+		Expect(line).To(HaveSuffix("second"))
+	})
+
+	Context("when the spool was partly replayed before being closed", func() {
+		var (
+			address   string
+			spoolSize int64
+			replayed  int
+		)
+
+		BeforeEach(func() {
+			address = unusedAddress()
+
+			drainer, err := syslog.NewDrainer(syslog.Drain{
+				Transport: "tcp",
+				Address:   address,
+				Spool:     &syslog.SpoolConfig{Dir: spoolDir},
+			}, "some-host")
+			Expect(err).NotTo(HaveOccurred())
+
+			drainer.Drain(message("first"))
+			drainer.Drain(message("second"))
+			drainer.Drain(message("third"))
+
+			Eventually(spooledLines).Should(Equal(3))
+			Expect(drainer.Close()).To(Succeed())
+
+			replayed = 2
+		})
+
+		JustBeforeEach(func() {
+			contents, err := ioutil.ReadFile(spoolFile())
+			Expect(err).NotTo(HaveOccurred())
+
+			spoolSize = int64(len(contents))
+
+			offset := 0
+			for _, line := range strings.SplitAfter(string(contents), "\n")[:replayed] {
+				offset += len(line)
+			}
+
+			err = ioutil.WriteFile(spoolFile()+".offset", []byte(strconv.Itoa(offset)), 0600)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("only replays the rest once reopened", func() {
+			var received chan string
+			listener, received = listenTCP(address)
+
+			drainer, err := syslog.NewDrainer(syslog.Drain{
+				Transport: "tcp",
+				Address:   address,
+				Spool:     &syslog.SpoolConfig{Dir: spoolDir},
+			}, "some-host")
+			Expect(err).NotTo(HaveOccurred())
+			defer drainer.Close()
+
+			var line string
+			Eventually(received, "5s").Should(Receive(&line))
+			Expect(line).To(HaveSuffix("third"))
+
+			drainer.Drain(message("fourth"))
+			Eventually(received).Should(Receive(HaveSuffix("fourth")))
+		})
+
+		It("does not count the replayed lines against its size", func() {
+			drainer, err := syslog.NewDrainer(syslog.Drain{
+				Transport: "tcp",
+				Address:   address,
+				Spool:     &syslog.SpoolConfig{Dir: spoolDir, MaxBytes: spoolSize},
+			}, "some-host")
+			Expect(err).NotTo(HaveOccurred())
+			defer drainer.Close()
+
+			results := make(chan error, 1)
+
+			fourth := message("fourth")
+			fourth.Done = func(err error) { results <- err }
+
+			Expect(drainer.Drain(fourth)).To(Succeed())
+			Eventually(results).Should(Receive(BeNil()))
+		})
+
+		Context("and the replayed lines take up half of its size", func() {
+			BeforeEach(func() {
+				replayed = 1
+			})
+
+			It("removes them and keeps replaying in order", func() {
+				var received chan string
+				listener, received = listenTCP(address)
+
+				drainer, err := syslog.NewDrainer(syslog.Drain{
+					Transport: "tcp",
+					Address:   address,
+					Spool:     &syslog.SpoolConfig{Dir: spoolDir, MaxBytes: spoolSize},
+				}, "some-host")
+				Expect(err).NotTo(HaveOccurred())
+				defer drainer.Close()
+
+				var line string
+				Eventually(received, "5s").Should(Receive(&line))
+				Expect(line).To(HaveSuffix("second"))
+
+				Eventually(received).Should(Receive(&line))
+				Expect(line).To(HaveSuffix("third"))
+
+				drainer.Drain(message("fourth"))
+				Eventually(received).Should(Receive(HaveSuffix("fourth")))
+			})
+		})
+	})
+})
@@ -0,0 +1,113 @@
+package syslog
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// DestinationStatus describes the connections to a destination, for
+// reporting on blackbox's health.
+type DestinationStatus struct {
+	Destination string    `json:"destination"`
+	State       ConnState `json:"state"`
+
+	// Since is when the destination entered its current state.
+	Since time.Time `json:"since"`
+}
+
+type destinationStatus struct {
+	workers   int
+	connected int
+	attempted bool
+	since     time.Time
+}
+
+var (
+	statuses     = map[string]*destinationStatus{}
+	statusesLock sync.Mutex
+)
+
+// Statuses returns the status of every destination that a drainer is open
+// for, ordered by destination. A destination is Connected if any of the
+// connections to it are.
+func Statuses() []DestinationStatus {
+	statusesLock.Lock()
+	defer statusesLock.Unlock()
+
+	var result []DestinationStatus
+
+	for destination, status := range statuses {
+		state := Disconnected
+		if status.connected > 0 {
+			state = Connected
+		} else if !status.attempted {
+			state = Connecting
+		}
+
+		result = append(result, DestinationStatus{
+			Destination: destination,
+			State:       state,
+			Since:       status.since,
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Destination < result[j].Destination
+	})
+
+	return result
+}
+
+// workerStarted registers a connection to the destination.
+func workerStarted(destination string) {
+	statusesLock.Lock()
+	defer statusesLock.Unlock()
+
+	status, found := statuses[destination]
+	if !found {
+		status = &destinationStatus{since: time.Now()}
+		statuses[destination] = status
+	}
+
+	status.workers++
+}
+
+// workerStopped forgets a connection to the destination, and the destination
+// itself once no connections to it are left.
+func workerStopped(destination string) {
+	statusesLock.Lock()
+	defer statusesLock.Unlock()
+
+	status := statuses[destination]
+
+	status.workers--
+	if status.workers == 0 {
+		delete(statuses, destination)
+	}
+}
+
+// stateChanged records that a connection to the destination went from one
+// state to another.
+func stateChanged(destination string, previous, state ConnState) {
+	statusesLock.Lock()
+	defer statusesLock.Unlock()
+
+	status := statuses[destination]
+	if status == nil {
+		return
+	}
+
+	wasConnected := status.connected > 0
+	status.attempted = true
+
+	if state == Connected {
+		status.connected++
+	} else if previous == Connected {
+		status.connected--
+	}
+
+	if wasConnected != (status.connected > 0) {
+		status.since = time.Now()
+	}
+}
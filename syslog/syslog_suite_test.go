@@ -0,0 +1,101 @@
+package syslog_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sync/atomic"
+
+	"github.com/concourse/blackbox/syslog"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+
+	"testing"
+)
+
+func TestSyslog(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Syslog Suite")
+}
+
+// Statuses are global, so a drainer left open would show up in the specs
+// that come after it.
+var _ = AfterEach(func() {
+	Expect(syslog.Statuses()).To(BeEmpty(), "every drainer must be closed")
+})
+
+// serveLines accepts connections on listener and sends every line received
+// on any of them to the returned channel.
+func serveLines(listener net.Listener) chan string {
+	return serveLinesCountingConnections(listener, nil)
+}
+
+// serveLinesCountingConnections is like serveLines, but also increments
+// connections for every connection accepted.
+func serveLinesCountingConnections(listener net.Listener, connections *int32) chan string {
+	received := make(chan string, 10)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			if connections != nil {
+				atomic.AddInt32(connections, 1)
+			}
+
+			go func() {
+				defer conn.Close()
+
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					received <- scanner.Text()
+				}
+			}()
+		}
+	}()
+
+	return received
+}
+
+// serveBytes accepts connections on listener and copies everything received
+// on them to the returned buffer, byte for byte.
+func serveBytes(listener net.Listener) *gbytes.Buffer {
+	buffer := gbytes.NewBuffer()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				io.Copy(buffer, conn)
+			}()
+		}
+	}()
+
+	return buffer
+}
+
+func listenTCP(address string) (net.Listener, chan string) {
+	listener, err := net.Listen("tcp", address)
+	Expect(err).NotTo(HaveOccurred())
+
+	return listener, serveLines(listener)
+}
+
+// unusedAddress returns a local address that nothing is listening on.
+func unusedAddress() string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).NotTo(HaveOccurred())
+	defer listener.Close()
+
+	return listener.Addr().String()
+}
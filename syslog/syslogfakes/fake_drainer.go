@@ -8,29 +8,33 @@ import (
 )
 
 type FakeDrainer struct {
-	DrainStub        func(line string, tag string) error
+	DrainStub        func(message syslog.Message) error
 	drainMutex       sync.RWMutex
 	drainArgsForCall []struct {
-		line string
-		tag  string
+		message syslog.Message
 	}
 	drainReturns struct {
 		result1 error
 	}
+	CloseStub        func() error
+	closeMutex       sync.RWMutex
+	closeArgsForCall []struct{}
+	closeReturns     struct {
+		result1 error
+	}
 	invocations      map[string][][]interface{}
 	invocationsMutex sync.RWMutex
 }
 
-func (fake *FakeDrainer) Drain(line string, tag string) error {
+func (fake *FakeDrainer) Drain(message syslog.Message) error {
 	fake.drainMutex.Lock()
 	fake.drainArgsForCall = append(fake.drainArgsForCall, struct {
-		line string
-		tag  string
-	}{line, tag})
-	fake.recordInvocation("Drain", []interface{}{line, tag})
+		message syslog.Message
+	}{message})
+	fake.recordInvocation("Drain", []interface{}{message})
 	fake.drainMutex.Unlock()
 	if fake.DrainStub != nil {
-		return fake.DrainStub(line, tag)
+		return fake.DrainStub(message)
 	} else {
 		return fake.drainReturns.result1
 	}
@@ -42,10 +46,10 @@ func (fake *FakeDrainer) DrainCallCount() int {
 	return len(fake.drainArgsForCall)
 }
 
-func (fake *FakeDrainer) DrainArgsForCall(i int) (string, string) {
+func (fake *FakeDrainer) DrainArgsForCall(i int) syslog.Message {
 	fake.drainMutex.RLock()
 	defer fake.drainMutex.RUnlock()
-	return fake.drainArgsForCall[i].line, fake.drainArgsForCall[i].tag
+	return fake.drainArgsForCall[i].message
 }
 
 func (fake *FakeDrainer) DrainReturns(result1 error) {
@@ -55,11 +59,38 @@ func (fake *FakeDrainer) DrainReturns(result1 error) {
 	}{result1}
 }
 
+func (fake *FakeDrainer) Close() error {
+	fake.closeMutex.Lock()
+	fake.closeArgsForCall = append(fake.closeArgsForCall, struct{}{})
+	fake.recordInvocation("Close", []interface{}{})
+	fake.closeMutex.Unlock()
+	if fake.CloseStub != nil {
+		return fake.CloseStub()
+	} else {
+		return fake.closeReturns.result1
+	}
+}
+
+func (fake *FakeDrainer) CloseCallCount() int {
+	fake.closeMutex.RLock()
+	defer fake.closeMutex.RUnlock()
+	return len(fake.closeArgsForCall)
+}
+
+func (fake *FakeDrainer) CloseReturns(result1 error) {
+	fake.CloseStub = nil
+	fake.closeReturns = struct {
+		result1 error
+	}{result1}
+}
+
 func (fake *FakeDrainer) Invocations() map[string][][]interface{} {
 	fake.invocationsMutex.RLock()
 	defer fake.invocationsMutex.RUnlock()
 	fake.drainMutex.RLock()
 	defer fake.drainMutex.RUnlock()
+	fake.closeMutex.RLock()
+	defer fake.closeMutex.RUnlock()
 	return fake.invocations
 }
 
@@ -0,0 +1,80 @@
+package syslog
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLSConfig configures the "tls" transport (RFC 5425). Certificates and keys
+// are read from PEM files.
+type TLSConfig struct {
+	// CAFile is a bundle of CAs to verify the server against. The system
+	// roots are used when it is empty.
+	CAFile string `yaml:"ca_file,omitempty"`
+
+	// CertFile and KeyFile are the client certificate and key presented to
+	// servers that require mutual TLS.
+	CertFile string `yaml:"cert_file,omitempty"`
+	KeyFile  string `yaml:"key_file,omitempty"`
+
+	// ServerName overrides the host name used to verify the server's
+	// certificate, which otherwise is taken from the address.
+	ServerName string `yaml:"server_name,omitempty"`
+
+	// MinVersion is the lowest TLS version to negotiate, e.g. "1.2" (the
+	// default).
+	MinVersion string `yaml:"min_version,omitempty"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func (c TLSConfig) Config() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: c.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if c.MinVersion != "" {
+		version, found := tlsVersions[c.MinVersion]
+		if !found {
+			return nil, fmt.Errorf("unknown TLS version: %s", c.MinVersion)
+		}
+
+		config.MinVersion = version
+	}
+
+	if c.CAFile != "" {
+		caPEM, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return nil, errors.New("both cert_file and key_file must be set for mutual TLS")
+		}
+
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,162 @@
+package blackbox
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+)
+
+const (
+	DEFAULT_TAG_TEMPLATE    = "{{.Dir}}"
+	DEFAULT_TAG_REPLACEMENT = "_"
+
+	// DEFAULT_TAG_MAX_LENGTH is the longest tag allowed by RFC 3164.
+	DEFAULT_TAG_MAX_LENGTH = 32
+)
+
+var defaultInvalidTagCharacters = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+var defaultTagTemplate = template.Must(template.New("tag").Parse(DEFAULT_TAG_TEMPLATE))
+
+type Template struct {
+	*template.Template
+
+	source string
+}
+
+func (t *Template) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var str string
+	if err := unmarshal(&str); err != nil {
+		return err
+	}
+
+	if str == "" {
+		t.Template = nil
+		t.source = ""
+		return nil
+	}
+
+	parsed, err := template.New("tag").Option("missingkey=zero").Parse(str)
+	if err != nil {
+		return err
+	}
+
+	t.Template = parsed
+	t.source = str
+
+	return nil
+}
+
+func (t Template) MarshalYAML() (interface{}, error) {
+	return t.source, nil
+}
+
+// TagConfig determines the tag of each file from its path relative to the
+// source dir.
+//
+// Template is a text/template that can refer to the directory the file is in
+// ({{.Dir}}, the default), the first directory of its path ({{.TopDir}}), its
+// name ({{.FileName}}) and its name without extension ({{.FileBase}}). If
+// Pattern is set, it is matched against the relative path and its named
+// captures can be referred to as well, e.g. {{.app}}. Files whose tag cannot
+// be rendered, or is empty, are not tailed.
+type TagConfig struct {
+	Template Template       `yaml:"template,omitempty"`
+	Pattern  Regexp         `yaml:"pattern,omitempty"`
+	Sanitize SanitizeConfig `yaml:"sanitize,omitempty"`
+}
+
+// SanitizeConfig makes tags valid for syslog by replacing each run of
+// Invalid characters with Replacement and truncating them to MaxLength. By
+// default anything but letters, digits, '.', '_' and '-' is replaced with '_'
+// and tags are truncated to 32 bytes; a negative MaxLength disables
+// truncation.
+type SanitizeConfig struct {
+	Invalid     Regexp  `yaml:"invalid,omitempty"`
+	Replacement *string `yaml:"replacement,omitempty"`
+	MaxLength   int     `yaml:"max_length,omitempty"`
+}
+
+func (c TagConfig) Tag(relPath string) (string, error) {
+	relPath = filepath.ToSlash(relPath)
+	dir := path.Dir(relPath)
+	fileName := path.Base(relPath)
+
+	fields := map[string]string{
+		"Path":     relPath,
+		"Dir":      dir,
+		"TopDir":   strings.SplitN(dir, "/", 2)[0],
+		"FileName": fileName,
+		"FileBase": strings.TrimSuffix(fileName, path.Ext(fileName)),
+	}
+
+	if c.Pattern.Regexp != nil {
+		match := c.Pattern.FindStringSubmatch(relPath)
+		for i, name := range c.Pattern.SubexpNames() {
+			if name != "" && match != nil {
+				fields[name] = match[i]
+			}
+		}
+	}
+
+	tmpl := c.Template.Template
+	if tmpl == nil {
+		tmpl = defaultTagTemplate
+	}
+
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, fields); err != nil {
+		return "", err
+	}
+
+	tag := c.Sanitize.sanitize(rendered.String())
+	if tag == "" {
+		return "", fmt.Errorf("tag for %s is empty", relPath)
+	}
+
+	return tag, nil
+}
+
+func (c SanitizeConfig) sanitize(tag string) string {
+	invalid := c.Invalid.Regexp
+	if invalid == nil {
+		invalid = defaultInvalidTagCharacters
+	}
+
+	replacement := DEFAULT_TAG_REPLACEMENT
+	if c.Replacement != nil {
+		replacement = *c.Replacement
+	}
+
+	maxLength := c.MaxLength
+	if maxLength == 0 {
+		maxLength = DEFAULT_TAG_MAX_LENGTH
+	}
+
+	tag = invalid.ReplaceAllString(tag, replacement)
+
+	if maxLength > 0 {
+		tag = truncate(tag, maxLength)
+	}
+
+	return tag
+}
+
+// truncate returns the longest prefix of tag that is at most maxLength bytes
+// long and does not end partway through a character.
+func truncate(tag string, maxLength int) string {
+	if len(tag) <= maxLength {
+		return tag
+	}
+
+	for maxLength > 0 && !utf8.RuneStart(tag[maxLength]) {
+		maxLength--
+	}
+
+	return tag[:maxLength]
+}
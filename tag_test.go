@@ -0,0 +1,91 @@
+package blackbox_test
+
+import (
+	. "github.com/concourse/blackbox"
+	"gopkg.in/yaml.v2"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TagConfig", func() {
+	var config TagConfig
+
+	load := func(source string) {
+		config = TagConfig{}
+		err := yaml.Unmarshal([]byte(source), &config)
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	tag := func(relPath string) string {
+		tag, err := config.Tag(relPath)
+		Expect(err).NotTo(HaveOccurred())
+		return tag
+	}
+
+	It("defaults to the directory of the file", func() {
+		load(`{}`)
+		Expect(tag("app1/stdout.log")).To(Equal("app1"))
+	})
+
+	It("replaces characters that are not valid in a tag", func() {
+		load(`{}`)
+		Expect(tag("app1/sub/deeper/stdout.log")).To(Equal("app1_sub_deeper"))
+	})
+
+	It("truncates tags to 32 characters", func() {
+		load(`{}`)
+		Expect(tag("an-application-with-a-very-long-name/stdout.log")).To(Equal("an-application-with-a-very-long-"))
+	})
+
+	It("does not truncate tags partway through a character", func() {
+		load(`
+sanitize:
+  invalid: '[/]+'
+  max_length: 8
+`)
+		Expect(tag("añañaña/stdout.log")).To(Equal("añaña"))
+	})
+
+	It("renders the template with fields from the path", func() {
+		load(`template: "{{.TopDir}}-{{.FileBase}}"`)
+		Expect(tag("app1/sub/stderr.log")).To(Equal("app1-stderr"))
+	})
+
+	It("makes named captures of the pattern available to the template", func() {
+		load(`
+pattern: '^jobs/(?P<job>[^/]+)/(?P<process>[^/]+)/'
+template: "{{.job}}.{{.process}}"
+`)
+		Expect(tag("jobs/web/nginx/access.log")).To(Equal("web.nginx"))
+	})
+
+	It("uses the configured sanitization rules", func() {
+		load(`
+template: "{{.Path}}"
+sanitize:
+  invalid: '[^a-z/]+'
+  replacement: ""
+  max_length: -1
+`)
+		Expect(tag("app1/sub/std-out.log")).To(Equal("app/sub/stdoutlog"))
+	})
+
+	It("returns an error if the template cannot be rendered", func() {
+		load(`template: "{{.Dir.Name}}"`)
+
+		_, err := config.Tag("app1/stdout.log")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("returns an error if the tag is empty", func() {
+		load(`
+pattern: '^(?P<app>app1)/'
+template: "{{.app}}"
+`)
+		Expect(tag("app1/stdout.log")).To(Equal("app1"))
+
+		_, err := config.Tag("app2/stdout.log")
+		Expect(err).To(MatchError("tag for app2/stdout.log is empty"))
+	})
+})
@@ -1,33 +1,106 @@
 package blackbox
 
 import (
+	"bytes"
 	"log"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/hpcloud/tail"
 	"github.com/hpcloud/tail/watch"
 
+	"github.com/concourse/blackbox/metrics"
 	"github.com/concourse/blackbox/syslog"
 )
 
 type Tailer struct {
-	Path    string
-	Tag     string
-	Drainer syslog.Drainer
+	Path     string
+	Tag      string
+	Facility syslog.Facility
+	Severity syslog.Severity
+	Drainer  syslog.Drainer
+
+	// Multiline, when set, joins consecutive lines of an event such as a
+	// stack trace into a single message.
+	Multiline *MultilineRule
+
+	// SeverityPatterns are checked against every line, and the first one to
+	// match determines its severity. Lines that match none are sent with
+	// Severity.
+	SeverityPatterns []SeverityPattern
+
+	// JSON, when set, parses lines as JSON objects. The severity found in a
+	// line takes precedence over SeverityPatterns, which are otherwise
+	// checked against its message.
+	JSON *JSONRule
+
+	// FromStart causes the file to be read from the beginning rather than
+	// from the end, for files that appeared after blackbox started.
+	FromStart bool
+
+	// Poll checks the file for changes periodically instead of using
+	// inotify.
+	Poll bool
+
+	// Checkpoints, when set, is used to resume from and record the offset
+	// of the last line delivered by the Drainer.
+	Checkpoints *Checkpoints
+
+	// ShutdownGracePeriod is how long the tailer keeps going once signalled
+	// to stop, reading the rest of the file and waiting for the lines it read
+	// to be delivered. With none, it stops as soon as it is signalled.
+	ShutdownGracePeriod time.Duration
+
+	deliveries *deliveries
+
+	// abort is closed once the tailer gives up on delivering lines, so that
+	// it is not held up by a Drainer whose queue is full.
+	abort     chan struct{}
+	abortOnce sync.Once
 }
 
-func (tailer *Tailer) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+// position tracks the offset of the next unread line in the file that is
+// currently being tailed.
+type position struct {
+	info   os.FileInfo
+	offset int64
+}
+
+func init() {
 	watch.POLL_DURATION = 1 * time.Second
+}
+
+func (tailer *Tailer) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	// stopBy is when shutting down must be over with, once signalled
+	var stopBy time.Time
+	defer func() {
+		tailer.closeDrainer(stopBy)
+	}()
+
+	location, pos := tailer.startLocation()
+
+	tailer.deliveries = &deliveries{
+		path:        tailer.Path,
+		checkpoints: tailer.Checkpoints,
+	}
+
+	tailer.abort = make(chan struct{})
+
+	stopped := make(chan struct{})
+	defer close(stopped)
+
+	reopens := &reopenNotifier{
+		reopened: make(chan struct{}),
+		stopped:  stopped,
+	}
 
 	t, err := tail.TailFile(tailer.Path, tail.Config{
-		Follow: true,
-		ReOpen: true,
-		Poll:   true,
-		Location: &tail.SeekInfo{
-			Offset: 0,
-			Whence: os.SEEK_END,
-		},
+		Follow:   true,
+		ReOpen:   true,
+		Poll:     tailer.Poll,
+		Location: location,
+		Logger:   log.New(reopens, "", log.LstdFlags),
 	})
 
 	if err != nil {
@@ -37,19 +110,281 @@ func (tailer *Tailer) Run(signals <-chan os.Signal, ready chan<- struct{}) error
 
 	close(ready)
 
+	// signals are watched apart from the loop below, so that the grace
+	// period also runs out while it is waiting for room in the Drainer's
+	// queue
+	stopping := make(chan os.Signal)
+	go tailer.watchSignals(signals, stopping, stopped)
+
+	buffer := &multilineBuffer{rule: tailer.Multiline}
+	var flushTimeout <-chan time.Time
+	var gracePeriodOver <-chan struct{}
+
+	flush := func() {
+		if buffer.pending() {
+			tailer.drain(buffer.take(), pos)
+		}
+
+		flushTimeout = nil
+	}
+
 	for {
 		select {
 		case line, ok := <-t.Lines:
 			if !ok {
+				flush()
 				log.Println("lines flushed; exiting tailer")
 				return nil
 			}
 
-			tailer.Drainer.Drain(line.Text, tailer.Tag)
-		case <-signals:
-			return t.Stop()
+			metrics.LinesRead.WithLabelValues(tailer.Tag).Inc()
+			metrics.BytesRead.WithLabelValues(tailer.Tag).Add(float64(len(line.Text) + 1))
+
+			if !buffer.continues(line.Text) {
+				flush()
+			}
+
+			tailer.advance(pos, int64(len(line.Text)+1))
+			buffer.add(line.Text)
+
+			if buffer.full() {
+				flush()
+			} else {
+				flushTimeout = time.After(buffer.flushTimeout())
+			}
+		case <-reopens.reopened:
+			// everything before this came from the file that was open
+			// before, so what is buffered is checkpointed against it
+			flush()
+			pos.reset(tailer.Path)
+		case <-flushTimeout:
+			flush()
+		case <-gracePeriodOver:
+			log.Printf("shutdown grace period is over; stopping before the end of %s\n", tailer.Path)
+			flush()
+			return nil
+		case <-stopping:
+			if tailer.ShutdownGracePeriod <= 0 || !stopBy.IsZero() {
+				// no grace period, or signalled again while in it
+				flush()
+				return t.Stop()
+			}
+
+			stopBy = time.Now().Add(tailer.ShutdownGracePeriod)
+			gracePeriodOver = tailer.abort
+
+			// lines keep coming until the end of the file, after which they
+			// are closed
+			go t.StopAtEOF()
+		}
+	}
+}
+
+// closeDrainer closes the Drainer, which waits for the lines it has queued to
+// be delivered, giving up at stopBy if it is set.
+func (tailer *Tailer) closeDrainer(stopBy time.Time) {
+	if closed, _ := closeBy(tailer.Drainer, stopBy); !closed {
+		log.Printf("shutdown grace period is over; not waiting for lines from %s to be delivered\n", tailer.Path)
+	}
+}
+
+// closeBy closes a Drainer, waiting until stopBy at most, or for as long as
+// it takes if stopBy is zero. It returns false if it gave up waiting, in
+// which case Close is left to finish in the background.
+func closeBy(drainer syslog.Drainer, stopBy time.Time) (bool, error) {
+	if stopBy.IsZero() {
+		return true, drainer.Close()
+	}
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- drainer.Close()
+	}()
+
+	select {
+	case err := <-closed:
+		return true, err
+	case <-time.After(time.Until(stopBy)):
+		return false, nil
+	}
+}
+
+// watchSignals passes signals on to stopping. Once signalled, it gives up on
+// handing lines to the Drainer when the grace period is over, or straight
+// away if there is none or it is signalled again.
+func (tailer *Tailer) watchSignals(signals <-chan os.Signal, stopping chan<- os.Signal, stopped <-chan struct{}) {
+	signalled := false
+
+	for {
+		select {
+		case sig := <-signals:
+			if tailer.ShutdownGracePeriod <= 0 || signalled {
+				tailer.giveUp()
+			} else {
+				time.AfterFunc(tailer.ShutdownGracePeriod, tailer.giveUp)
+			}
+
+			signalled = true
+
+			select {
+			case stopping <- sig:
+			case <-stopped:
+				return
+			}
+		case <-stopped:
+			return
+		}
+	}
+}
+
+// giveUp stops waiting to hand lines to the Drainer. Lines that are not
+// handed over are reported as ErrClosed, so they are read again on restart.
+func (tailer *Tailer) giveUp() {
+	tailer.abortOnce.Do(func() {
+		close(tailer.abort)
+	})
+}
+
+// drain sends a complete event and, once it has been delivered, checkpoints
+// the position just past its last line.
+func (tailer *Tailer) drain(event string, pos *position) {
+	var checkpoint *Checkpoint
+	if pos != nil && pos.info != nil {
+		c := CheckpointFor(pos.info, pos.offset)
+		checkpoint = &c
+	}
+
+	message := tailer.message(event)
+
+	// the delivery result, including any error from Drain itself, is
+	// reported to Done
+	message.Done = tailer.deliveries.add(checkpoint)
+	message.Abort = tailer.abort
+
+	tailer.Drainer.Drain(message)
+}
+
+func (tailer *Tailer) message(event string) syslog.Message {
+	message := syslog.Message{
+		Line:     event,
+		Tag:      tailer.Tag,
+		Facility: tailer.Facility,
+		Path:     tailer.Path,
+	}
+
+	if tailer.JSON != nil {
+		if parsed, ok := tailer.JSON.parse(event); ok {
+			message.Line = parsed.message
+			message.Time = parsed.time
+			message.Fields = parsed.fields
+
+			if parsed.severity != nil {
+				message.Severity = *parsed.severity
+				return message
+			}
+		}
+	}
+
+	message.Severity = tailer.severityFor(message.Line)
+
+	return message
+}
+
+func (tailer *Tailer) severityFor(line string) syslog.Severity {
+	for _, pattern := range tailer.SeverityPatterns {
+		if pattern.Pattern.MatchString(line) {
+			return pattern.Severity
+		}
+	}
+
+	return tailer.Severity
+}
+
+// startLocation determines where to begin reading. A checkpoint is only
+// honoured if it was taken against the same file; otherwise the tailer
+// starts at the beginning of new files and at the end of existing ones.
+func (tailer *Tailer) startLocation() (*tail.SeekInfo, *position) {
+	location := &tail.SeekInfo{Offset: 0, Whence: os.SEEK_END}
+	if tailer.FromStart {
+		location.Whence = os.SEEK_SET
+	}
+
+	if tailer.Checkpoints == nil {
+		return location, nil
+	}
+
+	info, err := os.Stat(tailer.Path)
+	if err != nil {
+		return location, &position{}
+	}
+
+	pos := &position{info: info, offset: info.Size()}
+	if tailer.FromStart {
+		pos.offset = 0
+	}
+
+	checkpoint, found := tailer.Checkpoints.Get(tailer.Path)
+	if found && checkpoint.Matches(info) {
+		pos.offset = checkpoint.Offset
+
+		if pos.offset > info.Size() {
+			// the file was truncated since the checkpoint was taken
+			pos.offset = 0
+		}
+	}
+
+	return &tail.SeekInfo{Offset: pos.offset, Whence: os.SEEK_SET}, pos
+}
+
+// advance moves the tracked offset past a line of the given length. The
+// checkpoint itself is only recorded once the line has been delivered, so a
+// restart never skips a line that did not make it to the destination.
+func (tailer *Tailer) advance(pos *position, length int64) {
+	if pos == nil {
+		return
+	}
+
+	if pos.info == nil {
+		// the file did not exist when the tailer started, and has been
+		// opened since
+		pos.reset(tailer.Path)
+	}
+
+	pos.offset += length
+}
+
+// reset moves the position to the start of the file now at path, which the
+// tail has just opened.
+func (pos *position) reset(path string) {
+	if pos == nil {
+		return
+	}
+
+	pos.info = nil
+	pos.offset = 0
+
+	if info, err := os.Stat(path); err == nil {
+		pos.info = info
+	}
+}
+
+// reopenNotifier passes on the tail library's log output, and reports when
+// it has reopened the file after a rotation or truncation. The library only
+// says so in its log, which it writes after opening the new file and before
+// sending any of its lines, so blocking until the tailer has taken the
+// report keeps it in order with the lines.
+type reopenNotifier struct {
+	reopened chan struct{}
+	stopped  <-chan struct{}
+}
+
+func (n *reopenNotifier) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte("Successfully reopened")) {
+		select {
+		case n.reopened <- struct{}{}:
+		case <-n.stopped:
 		}
 	}
 
-	return nil
+	return os.Stderr.Write(p)
 }
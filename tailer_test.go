@@ -0,0 +1,460 @@
+package blackbox_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/tedsuo/ifrit"
+	"github.com/tedsuo/ifrit/ginkgomon"
+
+	. "github.com/concourse/blackbox"
+	"github.com/concourse/blackbox/metrics"
+	"github.com/concourse/blackbox/syslog"
+	"github.com/concourse/blackbox/syslog/syslogfakes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Tailer", func() {
+	var (
+		logDir  string
+		logPath string
+		drainer *syslogfakes.FakeDrainer
+		tailer  *Tailer
+		process ifrit.Process
+	)
+
+	drained := func() []syslog.Message {
+		messages := []syslog.Message{}
+		for i := 0; i < drainer.DrainCallCount(); i++ {
+			messages = append(messages, drainer.DrainArgsForCall(i))
+		}
+		return messages
+	}
+
+	lines := func() []string {
+		texts := []string{}
+		for _, message := range drained() {
+			texts = append(texts, message.Line)
+		}
+		return texts
+	}
+
+	BeforeEach(func() {
+		var err error
+		logDir, err = ioutil.TempDir("", "tailer-test")
+		Expect(err).NotTo(HaveOccurred())
+
+		logPath = filepath.Join(logDir, "app.log")
+		drainer = new(syslogfakes.FakeDrainer)
+
+		tailer = &Tailer{
+			Path:      logPath,
+			Tag:       "app",
+			Facility:  syslog.DefaultFacility,
+			Severity:  syslog.DefaultSeverity,
+			Drainer:   drainer,
+			FromStart: true,
+		}
+	})
+
+	JustBeforeEach(func() {
+		process = ginkgomon.Invoke(tailer)
+	})
+
+	AfterEach(func() {
+		ginkgomon.Interrupt(process)
+		os.RemoveAll(logDir)
+	})
+
+	Context("when lines are read", func() {
+		var linesBefore, bytesBefore float64
+
+		BeforeEach(func() {
+			linesBefore = testutil.ToFloat64(metrics.LinesRead.WithLabelValues("app"))
+			bytesBefore = testutil.ToFloat64(metrics.BytesRead.WithLabelValues("app"))
+
+			err := ioutil.WriteFile(logPath, []byte("hello\nworld\n"), 0644)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("counts them and their bytes by tag", func() {
+			Eventually(lines).Should(HaveLen(2))
+
+			Expect(testutil.ToFloat64(metrics.LinesRead.WithLabelValues("app")) - linesBefore).To(Equal(2.0))
+			Expect(testutil.ToFloat64(metrics.BytesRead.WithLabelValues("app")) - bytesBefore).To(Equal(12.0))
+		})
+	})
+
+	It("closes its drainer when it stops", func() {
+		ginkgomon.Interrupt(process)
+		Expect(drainer.CloseCallCount()).To(Equal(1))
+	})
+
+	Context("with a shutdown grace period", func() {
+		var release chan struct{}
+
+		BeforeEach(func() {
+			tailer.ShutdownGracePeriod = 5 * time.Second
+
+			release = make(chan struct{})
+			drainer.DrainStub = func(syslog.Message) error {
+				<-release
+				return nil
+			}
+
+			err := ioutil.WriteFile(logPath, []byte("one\ntwo\nthree\n"), 0644)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("reads the rest of the file before stopping", func() {
+			Eventually(drainer.DrainCallCount).Should(Equal(1))
+
+			process.Signal(os.Interrupt)
+			close(release)
+
+			Eventually(process.Wait()).Should(Receive(BeNil()))
+			Expect(lines()).To(Equal([]string{"one", "two", "three"}))
+			Expect(drainer.CloseCallCount()).To(Equal(1))
+		})
+
+		It("stops waiting for lines to be delivered once the grace period is over", func() {
+			tailer.ShutdownGracePeriod = 100 * time.Millisecond
+			close(release)
+
+			drainer.CloseStub = func() error {
+				select {}
+			}
+
+			Eventually(lines).Should(HaveLen(3))
+
+			process.Signal(os.Interrupt)
+			Eventually(process.Wait()).Should(Receive(BeNil()))
+		})
+
+		Context("when the destination is unreachable and its queue is full", func() {
+			var linesBefore float64
+
+			BeforeEach(func() {
+				linesBefore = testutil.ToFloat64(metrics.LinesRead.WithLabelValues("app"))
+
+				listener, err := net.Listen("tcp", "127.0.0.1:0")
+				Expect(err).NotTo(HaveOccurred())
+
+				address := listener.Addr().String()
+				listener.Close()
+
+				tailer.Drainer, err = syslog.NewDrainerFactory([]syslog.Drain{{
+					Transport: "tcp",
+					Address:   address,
+				}}, "some-host").NewDrainer()
+				Expect(err).NotTo(HaveOccurred())
+
+				tailer.ShutdownGracePeriod = 500 * time.Millisecond
+
+				err = ioutil.WriteFile(logPath, []byte(strings.Repeat("hello\n", 3000)), 0644)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("stops once the grace period is over", func() {
+				// more than fit in the queue
+				Eventually(func() float64 {
+					return testutil.ToFloat64(metrics.LinesRead.WithLabelValues("app")) - linesBefore
+				}).Should(BeNumerically(">", 1001))
+
+				process.Signal(os.Interrupt)
+				Eventually(process.Wait(), "2s").Should(Receive(BeNil()))
+			})
+		})
+	})
+
+	Context("with checkpoints", func() {
+		var (
+			stateDir    string
+			checkpoints *Checkpoints
+			results     chan func(error)
+		)
+
+		BeforeEach(func() {
+			var err error
+			stateDir, err = ioutil.TempDir("", "tailer-state")
+			Expect(err).NotTo(HaveOccurred())
+
+			checkpoints, err = LoadCheckpoints(log.New(GinkgoWriter, "", 0), filepath.Join(stateDir, "state.json"))
+			Expect(err).NotTo(HaveOccurred())
+
+			results = make(chan func(error), 10)
+			drainer.DrainStub = func(message syslog.Message) error {
+				results <- message.Done
+				return nil
+			}
+
+			err = ioutil.WriteFile(logPath, []byte("first\nsecond\n"), 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			tailer.Checkpoints = checkpoints
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(stateDir)
+		})
+
+		offset := func() int64 {
+			checkpoint, _ := checkpoints.Get(logPath)
+			return checkpoint.Offset
+		}
+
+		It("only checkpoints lines once they and every line before them are delivered", func() {
+			var first, second func(error)
+			Eventually(results).Should(Receive(&first))
+			Eventually(results).Should(Receive(&second))
+
+			second(nil)
+			Consistently(offset).Should(BeZero())
+
+			first(nil)
+			Eventually(offset).Should(Equal(int64(len("first\nsecond\n"))))
+		})
+
+		It("moves past lines that were dropped", func() {
+			var first, second func(error)
+			Eventually(results).Should(Receive(&first))
+			Eventually(results).Should(Receive(&second))
+
+			first(errors.New("dropped"))
+			second(nil)
+			Eventually(offset).Should(Equal(int64(len("first\nsecond\n"))))
+		})
+
+		It("does not move past lines that were not sent before the drainer closed", func() {
+			var first, second func(error)
+			Eventually(results).Should(Receive(&first))
+			Eventually(results).Should(Receive(&second))
+
+			first(nil)
+			second(syslog.ErrClosed)
+			Eventually(offset).Should(Equal(int64(len("first\n"))))
+		})
+		Context("when the file is rotated while lines from it are still being read", func() {
+			var release chan struct{}
+
+			BeforeEach(func() {
+				release = make(chan struct{})
+
+				drainer.DrainStub = func(message syslog.Message) error {
+					if message.Line == "first" {
+						<-release
+					}
+
+					message.Done(nil)
+					return nil
+				}
+			})
+
+			It("checkpoints them against the file they were read from", func() {
+				Eventually(drainer.DrainCallCount).Should(Equal(1))
+
+				rotated := logPath + ".1"
+				Expect(os.Rename(logPath, rotated)).To(Succeed())
+				Expect(ioutil.WriteFile(logPath, []byte{}, 0644)).To(Succeed())
+
+				close(release)
+				Eventually(lines).Should(Equal([]string{"first", "second"}))
+
+				info, err := os.Stat(rotated)
+				Expect(err).NotTo(HaveOccurred())
+
+				Eventually(offset).Should(Equal(int64(len("first\nsecond\n"))))
+
+				checkpoint, _ := checkpoints.Get(logPath)
+				Expect(checkpoint.Matches(info)).To(BeTrue())
+
+				Expect(ioutil.WriteFile(logPath, []byte("third\n"), 0644)).To(Succeed())
+				Eventually(lines, "5s").Should(HaveLen(3))
+
+				info, err = os.Stat(logPath)
+				Expect(err).NotTo(HaveOccurred())
+
+				Eventually(offset).Should(Equal(int64(len("third\n"))))
+
+				checkpoint, _ = checkpoints.Get(logPath)
+				Expect(checkpoint.Matches(info)).To(BeTrue())
+			})
+		})
+	})
+
+	Context("with severity patterns", func() {
+		BeforeEach(func() {
+			tailer.SeverityPatterns = []SeverityPattern{
+				{Pattern: Regexp{regexp.MustCompile(`\bERROR\b`)}, Severity: mustSeverity("err")},
+				{Pattern: Regexp{regexp.MustCompile(`level=warn`)}, Severity: mustSeverity("warning")},
+			}
+
+			err := ioutil.WriteFile(logPath, []byte("an ERROR occurred\nlevel=warn msg=hmm\nall good\n"), 0644)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("assigns the severity of the first matching pattern, falling back to the tailer's severity", func() {
+			Eventually(lines).Should(Equal([]string{"an ERROR occurred", "level=warn msg=hmm", "all good"}))
+
+			messages := drained()
+			Expect(messages[0].Severity.String()).To(Equal("err"))
+			Expect(messages[1].Severity.String()).To(Equal("warning"))
+			Expect(messages[2].Severity).To(Equal(syslog.DefaultSeverity))
+		})
+	})
+
+	Context("with a JSON rule", func() {
+		BeforeEach(func() {
+			tailer.JSON = &JSONRule{Tag: "app"}
+			tailer.SeverityPatterns = []SeverityPattern{
+				{Pattern: Regexp{regexp.MustCompile(`\bERROR\b`)}, Severity: mustSeverity("err")},
+			}
+
+			err := ioutil.WriteFile(logPath, []byte(
+				`{"timestamp":"1580000000.123456789","source":"app","message":"app.request.failed","log_level":2,"data":{"session":"1.2","error":"no such host","attempts":3}}`+"\n"+
+					`{"message":"ERROR in app"}`+"\n"+
+					"not json ERROR\n"+
+					`{"log_level":"warn","foo":1}`+"\n",
+			), 0644)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("takes the message, severity and timestamp from lines, sending the rest as fields", func() {
+			Eventually(lines).Should(Equal([]string{"app.request.failed", "ERROR in app", "not json ERROR", `{"log_level":"warn","foo":1}`}))
+
+			message := drained()[0]
+			Expect(message.Severity.String()).To(Equal("err"))
+			Expect(message.Time).To(Equal(time.Unix(1580000000, 123456789)))
+			Expect(message.Fields).To(Equal(map[string]string{
+				"source":        "app",
+				"data.session":  "1.2",
+				"data.error":    "no such host",
+				"data.attempts": "3",
+			}))
+		})
+
+		It("checks severity patterns against the message of lines without a severity", func() {
+			Eventually(lines).Should(HaveLen(4))
+
+			message := drained()[1]
+			Expect(message.Severity.String()).To(Equal("err"))
+			Expect(message.Time).To(BeZero())
+			Expect(message.Fields).To(BeEmpty())
+		})
+
+		It("passes lines that are not JSON through unchanged", func() {
+			Eventually(lines).Should(HaveLen(4))
+
+			message := drained()[2]
+			Expect(message.Severity.String()).To(Equal("err"))
+			Expect(message.Fields).To(BeNil())
+		})
+
+		It("sends the whole line of objects without a message, taking only their severity", func() {
+			Eventually(lines).Should(HaveLen(4))
+
+			message := drained()[3]
+			Expect(message.Line).To(Equal(`{"log_level":"warn","foo":1}`))
+			Expect(message.Severity.String()).To(Equal("warning"))
+			Expect(message.Fields).To(BeEmpty())
+		})
+
+		Context("with other field names", func() {
+			BeforeEach(func() {
+				tailer.JSON = &JSONRule{
+					Tag:            "app",
+					MessageField:   "msg",
+					SeverityField:  "level",
+					TimestampField: "ts",
+				}
+
+				err := ioutil.WriteFile(logPath, []byte(`{"ts":"2020-01-26T00:53:20.5Z","level":"warn","msg":"slow"}`+"\n"), 0644)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("reads them instead", func() {
+				Eventually(lines).Should(Equal([]string{"slow"}))
+
+				message := drained()[0]
+				Expect(message.Severity.String()).To(Equal("warning"))
+				Expect(message.Time.Equal(time.Date(2020, 1, 26, 0, 53, 20, 500000000, time.UTC))).To(BeTrue())
+				Expect(message.Fields).To(BeEmpty())
+			})
+		})
+	})
+
+	Context("with a multiline rule", func() {
+		BeforeEach(func() {
+			tailer.Multiline = &MultilineRule{
+				Tag:          "app",
+				Continuation: Regexp{regexp.MustCompile(`^(\s|Caused by:)`)},
+				MaxLines:     3,
+				FlushTimeout: Duration(100 * time.Millisecond),
+			}
+		})
+
+		It("joins continuation lines into the preceding line", func() {
+			err := ioutil.WriteFile(logPath, []byte(
+				"Exception in thread main\n"+
+					"\tat Foo.bar\n"+
+					"Caused by: something\n"+
+					"next line\n",
+			), 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			Eventually(lines).Should(Equal([]string{
+				"Exception in thread main\n\tat Foo.bar\nCaused by: something",
+				"next line",
+			}))
+		})
+
+		Context("with a start pattern too", func() {
+			BeforeEach(func() {
+				tailer.Multiline.Start = Regexp{regexp.MustCompile(`^\s*BEGIN`)}
+			})
+
+			It("begins a new event at a line matching start, even if it also matches continuation", func() {
+				err := ioutil.WriteFile(logPath, []byte(
+					"BEGIN one\n"+
+						"\tdetail\n"+
+						"  BEGIN two\n"+
+						"\tmore\n"+
+						"next line\n",
+				), 0644)
+				Expect(err).NotTo(HaveOccurred())
+
+				Eventually(lines).Should(Equal([]string{
+					"BEGIN one\n\tdetail",
+					"  BEGIN two\n\tmore",
+					"next line",
+				}))
+			})
+		})
+
+		It("sends an event once it reaches the maximum number of lines", func() {
+			err := ioutil.WriteFile(logPath, []byte("panic\n\tone\n\ttwo\n\tthree\n"), 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			Eventually(lines).Should(Equal([]string{
+				"panic\n\tone\n\ttwo",
+				"\tthree",
+			}))
+		})
+	})
+})
+
+func mustSeverity(name string) syslog.Severity {
+	severity, err := syslog.ParseSeverity(name)
+	Expect(err).NotTo(HaveOccurred())
+	return severity
+}